@@ -0,0 +1,85 @@
+package benchmark
+
+import (
+	"github.com/heiyeluren/xmm"
+	"testing"
+	"unsafe"
+)
+
+const batchSize = 1024
+
+func newBatchMemory(b *testing.B) xmm.XMemory {
+	f := &xmm.Factory{}
+	mm, err := f.CreateMemory(0.8)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return mm
+}
+
+// 逐个分配
+func BenchmarkAllocPerCall_Xmm(b *testing.B) {
+	mm := newBatchMemory(b)
+	size := unsafe.Sizeof(User{})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := mm.Alloc(size); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 批量分配，每次batchSize个
+func BenchmarkAllocBatch_Xmm(b *testing.B) {
+	mm := newBatchMemory(b)
+	size := unsafe.Sizeof(User{})
+	out := make([]unsafe.Pointer, batchSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i += batchSize {
+		n := batchSize
+		if b.N-i < n {
+			n = b.N - i
+		}
+		if _, err := mm.AllocBatch(size, n, out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 逐个释放
+func BenchmarkFreePerCall_Xmm(b *testing.B) {
+	mm := newBatchMemory(b)
+	out := make([]unsafe.Pointer, b.N)
+	if _, err := mm.AllocBatch(unsafe.Sizeof(User{}), b.N, out); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for _, p := range out {
+		if err := mm.Free(uintptr(p)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 批量释放，每次batchSize个
+func BenchmarkFreeBatch_Xmm(b *testing.B) {
+	mm := newBatchMemory(b)
+	out := make([]unsafe.Pointer, b.N)
+	if _, err := mm.AllocBatch(unsafe.Sizeof(User{}), b.N, out); err != nil {
+		b.Fatal(err)
+	}
+	addrs := make([]uintptr, b.N)
+	for i, p := range out {
+		addrs[i] = uintptr(p)
+	}
+	b.ResetTimer()
+	for i := 0; i < len(addrs); i += batchSize {
+		end := i + batchSize
+		if end > len(addrs) {
+			end = len(addrs)
+		}
+		if err := mm.FreeBatch(addrs[i:end]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package benchmark
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/heiyeluren/xmm"
+	"github.com/heiyeluren/xmm/collections"
+)
+
+const mapKeys = 1 << 16
+
+func mapTestKeys() [][]byte {
+	keys := make([][]byte, mapKeys)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+	return keys
+}
+
+func BenchmarkMapPut_Xmm(b *testing.B) {
+	mp, err := collections.NewMap(newBatchMemory(b), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := mapTestKeys()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i&(mapKeys-1)]
+		if err := mp.Put(key, key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMapPut_Go(b *testing.B) {
+	mp := make(map[string][]byte)
+	keys := mapTestKeys()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i&(mapKeys-1)]
+		mp[string(key)] = append([]byte(nil), key...)
+	}
+}
+
+func BenchmarkMapGet_Xmm(b *testing.B) {
+	mp, err := collections.NewMap(newBatchMemory(b), mapKeys)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := mapTestKeys()
+	for _, key := range keys {
+		if err := mp.Put(key, key); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := mp.Get(keys[i&(mapKeys-1)]); !ok {
+			b.Fatal("not found")
+		}
+	}
+}
+
+func BenchmarkConcurrentMapLoadOrStore_Xmm(b *testing.B) {
+	cm, err := xmm.NewConcurrentMap(newBatchMemory(b), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := mapTestKeys()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i&(mapKeys-1)]
+			if _, _, err := cm.LoadOrStore(key, key); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkConcurrentMapLoadOrStore_SyncMap(b *testing.B) {
+	var m sync.Map
+	keys := mapTestKeys()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i&(mapKeys-1)]
+			m.LoadOrStore(string(key), append([]byte(nil), key...))
+			i++
+		}
+	})
+}
+
+func BenchmarkConcurrentMapLoad_Xmm(b *testing.B) {
+	cm, err := xmm.NewConcurrentMap(newBatchMemory(b), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := mapTestKeys()
+	for _, key := range keys {
+		if err := cm.Store(key, key); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, ok := cm.Load(keys[i&(mapKeys-1)]); !ok {
+				b.Fatal("not found")
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkConcurrentMapLoad_SyncMap(b *testing.B) {
+	var m sync.Map
+	keys := mapTestKeys()
+	for _, key := range keys {
+		m.Store(string(key), append([]byte(nil), key...))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, ok := m.Load(string(keys[i&(mapKeys-1)])); !ok {
+				b.Fatal("not found")
+			}
+			i++
+		}
+	})
+}
+
+// GC时间：存入mapKeys*16个元素后强制GC
+func BenchmarkConcurrentMapGC_Xmm(b *testing.B) {
+	cm, err := xmm.NewConcurrentMap(newBatchMemory(b), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < mapKeys*16; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if err := cm.Store(key, key); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+}
+
+func BenchmarkConcurrentMapGC_SyncMap(b *testing.B) {
+	var m sync.Map
+	for i := 0; i < mapKeys*16; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		m.Store(key, []byte(key))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+	runtime.KeepAlive(&m)
+}
@@ -0,0 +1,64 @@
+package benchmark
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/heiyeluren/xmm"
+)
+
+func newBenchTree(b *testing.B, n int) *xmm.Tree {
+	tree := xmm.NewTreeWith(xmm.BytesAscSort)
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("key-%08d", i))
+		if err := tree.PutKV(k, k); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return tree
+}
+
+// BenchmarkTreeSnapshot_ReadOnly 没有写入时所有读共享同一个快照
+func BenchmarkTreeSnapshot_ReadOnly(b *testing.B) {
+	tree := newBenchTree(b, 1<<16)
+	key := []byte("key-00001234")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tree.Snapshot().Get(key)
+		}
+	})
+}
+
+// BenchmarkTreeSnapshot_WriteEach 每次写入后读快照，每次都要重建整个快照
+func BenchmarkTreeSnapshot_WriteEach(b *testing.B) {
+	for _, n := range []int{1 << 10, 1 << 16} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			tree := newBenchTree(b, n)
+			key := []byte("key-00000001")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := tree.PutKV(key, key); err != nil {
+					b.Fatal(err)
+				}
+				tree.Snapshot().Get(key)
+			}
+		})
+	}
+}
+
+// BenchmarkTreeGet_WriteEach 对照：同样的读写只用Get
+func BenchmarkTreeGet_WriteEach(b *testing.B) {
+	tree := newBenchTree(b, 1<<16)
+	key := []byte("key-00000001")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tree.PutKV(key, key); err != nil {
+			b.Fatal(err)
+		}
+		tree.Get(key)
+	}
+}
@@ -31,6 +31,10 @@ type gcBits uint32
 
 func newMarkBits(nelems uintptr, zero bool) (*gcBits, error) {
 	blocksNeeded := (nelems + 63) / 64
+	if blocksNeeded < 1 {
+		// 大对象span初始化时nelems为0，至少分配一个block，否则会和下一个bitmap共用内存
+		blocksNeeded = 1
+	}
 	uint32Needed := blocksNeeded * 2
 	allocator := newXAllocator(4 * uint32Needed)
 	p, err := allocator.alloc()
@@ -134,6 +138,13 @@ func markBitsForAddr(p uintptr, h *xHeap) error {
 	if err != nil {
 		return err
 	}
+	if s == nil {
+		return fmt.Errorf("addr(%d) is not in any span", p)
+	}
+	if base, _ := slotOf(s, p); base != p {
+		// 内部指针(如From2返回的第二个字符串)会标记到所在对象上，之后再释放对象本身会把标记翻转回来
+		return InteriorPointerError
+	}
 	objIndex := s.objIndex(p)
 	s.setMarkBitsForIndex(objIndex)
 	if logg {
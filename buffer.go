@@ -0,0 +1,211 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"unsafe"
+)
+
+// bufferMinRead ReadFrom每次Read前至少保留的空间
+const bufferMinRead = 512
+
+var BufferFreedError = errors.New("buffer is freed")
+
+// Buffer 数据保存在XMM内存中的可增长字节缓冲，类似bytes.Buffer/strings.Builder。
+// 容量按size class增长，超过最大size class后按页增长，增长时释放旧的内存。
+// Bytes、String返回的内容指向XMM内存，在下一次写入、Reset或Free之前有效
+type Buffer struct {
+	m    XMemory
+	data uintptr
+	len  uintptr
+	cap  uintptr
+}
+
+// NewBuffer 创建Buffer，size为初始容量(可以为0)
+func NewBuffer(m XMemory, size uintptr) (*Buffer, error) {
+	if m == nil {
+		return nil, NilError
+	}
+	b := &Buffer{m: m}
+	if size > 0 {
+		if err := b.grow(size); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// roundCap 容量向上取整到size class或者整页
+func (b *Buffer) roundCap(n uintptr) uintptr {
+	if n > _MaxSmallSize {
+		return Align(n, _PageSize)
+	}
+	if mm, ok := b.m.(*mm); ok {
+		return uintptr(mm.h.classes.size[mm.h.classes.sizeToClass(n)])
+	}
+	return n
+}
+
+// grow 保证至少还能写入n字节
+func (b *Buffer) grow(n uintptr) error {
+	if b.m == nil {
+		return BufferFreedError
+	}
+	if b.len+n <= b.cap {
+		return nil
+	}
+	newCap := b.cap * 2
+	if newCap < b.len+n {
+		newCap = b.len + n
+	}
+	newCap = b.roundCap(newCap)
+	p, err := b.m.Alloc(newCap)
+	if err != nil {
+		return err
+	}
+	old := b.data
+	if old != 0 {
+		copy(rawBytes(uintptr(p), b.len), rawBytes(old, b.len))
+	}
+	// 先换成新内存，旧内存释放失败时也不会泄漏p
+	b.data, b.cap = uintptr(p), newCap
+	if old != 0 {
+		return b.m.Free(old)
+	}
+	return nil
+}
+
+// Grow 保证至少还能写入n字节而不再分配
+func (b *Buffer) Grow(n int) error {
+	if n < 0 {
+		panic("xmm.Buffer.Grow: negative count")
+	}
+	return b.grow(uintptr(n))
+}
+
+func (b *Buffer) Write(p []byte) (int, error) {
+	if err := b.grow(uintptr(len(p))); err != nil {
+		return 0, err
+	}
+	copy(rawBytes(b.data+b.len, uintptr(len(p))), p)
+	b.len += uintptr(len(p))
+	return len(p), nil
+}
+
+func (b *Buffer) WriteString(s string) (int, error) {
+	if err := b.grow(uintptr(len(s))); err != nil {
+		return 0, err
+	}
+	copy(rawBytes(b.data+b.len, uintptr(len(s))), s)
+	b.len += uintptr(len(s))
+	return len(s), nil
+}
+
+func (b *Buffer) WriteByte(c byte) error {
+	if err := b.grow(1); err != nil {
+		return err
+	}
+	*(*byte)(unsafe.Pointer(b.data + b.len)) = c
+	b.len++
+	return nil
+}
+
+// ReadFrom 从r读取直到io.EOF
+func (b *Buffer) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		if err := b.grow(bufferMinRead); err != nil {
+			return total, err
+		}
+		n, err := r.Read(rawBytes(b.data+b.len, b.cap-b.len))
+		if n < 0 {
+			return total, errors.New("reader returned negative count from Read")
+		}
+		b.len += uintptr(n)
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// WriteTo 把内容写到w，写出的部分从Buffer中去掉(保留容量)
+func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	if b.len == 0 {
+		return 0, nil
+	}
+	n, err := w.Write(b.Bytes())
+	if n > 0 {
+		copy(rawBytes(b.data, b.len-uintptr(n)), rawBytes(b.data+uintptr(n), b.len-uintptr(n)))
+		b.len -= uintptr(n)
+	}
+	if err == nil && b.len > 0 {
+		err = io.ErrShortWrite
+	}
+	return int64(n), err
+}
+
+// Bytes 返回XMM内存中的内容，不拷贝
+func (b *Buffer) Bytes() []byte {
+	if b.data == 0 {
+		return nil
+	}
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{Data: b.data, Len: int(b.len), Cap: int(b.cap)}))
+}
+
+// String 返回XMM内存中的字符串，不拷贝
+func (b *Buffer) String() (s string) {
+	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
+	sh.Data, sh.Len = b.data, int(b.len)
+	return s
+}
+
+func (b *Buffer) Len() int {
+	return int(b.len)
+}
+
+func (b *Buffer) Cap() int {
+	return int(b.cap)
+}
+
+// Reset 清空并释放内存，之后可以继续写入
+func (b *Buffer) Reset() error {
+	if b.data == 0 {
+		return nil
+	}
+	data := b.data
+	b.data, b.len, b.cap = 0, 0, 0
+	return b.m.Free(data)
+}
+
+// Free 释放内存，之后不能再使用
+func (b *Buffer) Free() error {
+	if b.m == nil {
+		return nil
+	}
+	err := b.Reset()
+	b.m = nil
+	return err
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+var (
+	_ io.Writer     = (*Buffer)(nil)
+	_ io.ByteWriter = (*Buffer)(nil)
+	_ io.ReaderFrom = (*Buffer)(nil)
+	_ io.WriterTo   = (*Buffer)(nil)
+)
+
+func TestBuffer(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBuffer(m, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	lastCap := 0
+	for i := 0; i < 20000; i++ {
+		s := strings.Repeat("x", i%17) + "|"
+		if _, err := b.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.WriteByte(byte(i)); err != nil {
+			t.Fatal(err)
+		}
+		want.WriteString(s)
+		want.WriteByte(byte(i))
+		if b.Cap() != lastCap {
+			// 小于最大size class时按class增长，之后按页增长
+			if c := uintptr(b.Cap()); c <= _MaxSmallSize {
+				h := m.(*mm).h
+				if uintptr(h.classes.size[h.classes.sizeToClass(c)]) != c {
+					t.Fatal("cap not a class size", c)
+				}
+			} else if c%_PageSize != 0 {
+				t.Fatal("cap not page aligned", c)
+			}
+			lastCap = b.Cap()
+		}
+	}
+	if !bytes.Equal(b.Bytes(), want.Bytes()) || b.String() != want.String() {
+		t.Fatal("content mismatch")
+	}
+	if _, err := m.(*mm).h.spanOf(stringData(b.String())); err != nil {
+		t.Fatal("not in xmm", err)
+	}
+
+	var out bytes.Buffer
+	n, err := b.WriteTo(&out)
+	if err != nil || n != int64(want.Len()) || !bytes.Equal(out.Bytes(), want.Bytes()) || b.Len() != 0 {
+		t.Fatal("WriteTo", n, err, b.Len())
+	}
+
+	src := strings.Repeat("0123456789", 10000)
+	n, err = b.ReadFrom(strings.NewReader(src))
+	if err != nil || n != int64(len(src)) || b.String() != src {
+		t.Fatal("ReadFrom", n, err)
+	}
+
+	if err := b.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 || b.Cap() != 0 || b.String() != "" {
+		t.Fatal("Reset")
+	}
+	if _, err := b.Write([]byte("again")); err != nil || b.String() != "again" {
+		t.Fatal("write after Reset", err)
+	}
+	if err := b.Free(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write([]byte("x")); err != BufferFreedError {
+		t.Fatal("write after Free", err)
+	}
+}
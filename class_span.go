@@ -54,6 +54,11 @@ func (x *xClassSpan) Init(classIndex uint, heap *xHeap) error {
 }
 
 func (x *xClassSpan) allocSpan(index int, f float32) (*xSpan, error) {
+	return x.allocSpanPages(f, x.heap.classes.spanPages(index))
+}
+
+// allocSpanPages 同allocSpan，没有可复用的span时分配pageNum页的新span
+func (x *xClassSpan) allocSpanPages(f float32, pageNum uintptr) (*xSpan, error) {
 	if x.free.first != nil {
 		span, err := func() (*xSpan, error) {
 			return x.free.moveHead(), nil
@@ -63,11 +68,19 @@ func (x *xClassSpan) allocSpan(index int, f float32) (*xSpan, error) {
 			return span, nil
 		}
 	}
+	return x.newSpanPages(f, pageNum)
+}
+
+// newSpan 从堆中分配新的span，不复用free链表中的
+func (x *xClassSpan) newSpan(f float32) (*xSpan, error) {
+	return x.newSpanPages(f, x.heap.classes.spanPages(int(x.classIndex)))
+}
+
+func (x *xClassSpan) newSpanPages(f float32, pageNum uintptr) (*xSpan, error) {
 	heap := x.heap
-	pageNum := class_to_allocnpages[index]
-	size := class_to_size[index]
-	pageNum = uint8(Align(Align(uintptr(size), _PageSize)/uintptr(_PageSize), uintptr(pageNum)))
-	span, err := heap.allocSpan(uintptr(pageNum), uint(index), uintptr(size), f)
+	index := int(x.classIndex)
+	size := heap.classes.size[index]
+	span, err := heap.allocSpan(pageNum, uint(index), uintptr(size), f)
 	// log.Printf("xClassSpan heap.allocSpan class:%d  free申请 span:%d\n", x.classIndex, unsafe.Pointer(span))
 	if err != nil {
 		return nil, err
@@ -123,6 +136,11 @@ func (x *xClassSpan) freeSpan(span *xSpan) (swap bool, size uint, err error) {
 		}
 		span.refillAllocCache(0)
 		// log.Printf("refillAllocCache allocCache:%.64b gcCount:%d allocCount:%d gcCount:%d oldallocCount:%d\n", span.allocCache, gcCount, span.allocCount, gcCount, allocCount)
+		// 判断当前span是否不在使用，不在使用存放进去。在使用则
+		// log.Printf("xClassSpan class:%d 回收 span:%d\n", x.classIndex, unsafe.Pointer(span))
+		// 先从full中移除，insert会改写span.next。在span锁内移动，Compact据此判断span所在的链表
+		x.full.move(span)
+		x.free.insert(span)
 		return nil
 	}()
 	if err != nil {
@@ -131,8 +149,5 @@ func (x *xClassSpan) freeSpan(span *xSpan) (swap bool, size uint, err error) {
 	if !needFree {
 		return false, 0, nil
 	}
-	// 判断当前span是否不在使用，不在使用存放进去。在使用则
-	// log.Printf("xClassSpan class:%d 回收 span:%d\n", x.classIndex, unsafe.Pointer(span))
-	x.free.insert(span)
 	return true, size, nil
 }
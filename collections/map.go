@@ -0,0 +1,360 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+// Package collections 基于XMM内存的容器，桶、节点以及key/value都分配在XMM中，不增加Go GC的扫描负担
+package collections
+
+import (
+	"errors"
+	"reflect"
+	"unsafe"
+
+	"github.com/heiyeluren/xmm"
+)
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+
+	mapMinBuckets = 16
+	// mapLoadFactor 平均每个桶的entry数超过mapLoadFactor时扩容
+	mapLoadFactor = 2
+	// mapEvacuateStep 扩容期间每次Put/Delete搬迁的旧桶数
+	mapEvacuateStep = 2
+)
+
+var MapFreedError = errors.New("map is freed")
+
+var MapEntryTooLargeError = errors.New("key or value is larger than 4GiB")
+
+// mapEntry 拉链中的一项，后面紧跟key和value的内容。next和桶都指向XMM内存，GC不会扫描也不会回收
+type mapEntry struct {
+	next   *mapEntry
+	hash   uint64
+	keyLen uint32
+	valLen uint32
+}
+
+const mapEntrySize = unsafe.Sizeof(mapEntry{})
+
+func (e *mapEntry) key() []byte {
+	return bytesAt(unsafe.Add(unsafe.Pointer(e), mapEntrySize), uintptr(e.keyLen))
+}
+
+func (e *mapEntry) value() []byte {
+	return bytesAt(unsafe.Add(unsafe.Pointer(e), mapEntrySize+uintptr(e.keyLen)), uintptr(e.valLen))
+}
+
+func bytesAt(p unsafe.Pointer, n uintptr) []byte {
+	if n == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(p), n)
+}
+
+func stringAt(p unsafe.Pointer, n uintptr) (s string) {
+	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
+	sh.Data, sh.Len = uintptr(p), int(n)
+	return s
+}
+
+func stringBytes(s string) []byte {
+	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
+	return bytesAt(unsafe.Pointer(sh.Data), uintptr(sh.Len))
+}
+
+func hashBytes(b []byte) uint64 {
+	h := uint64(fnvOffset64)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= fnvPrime64
+	}
+	return h
+}
+
+// bucketArray XMM中的桶数组，每个桶是拉链头entry
+type bucketArray struct {
+	addr unsafe.Pointer
+	n    uintptr // 2的幂
+}
+
+func (b bucketArray) slot(hash uint64) **mapEntry {
+	return b.at(uintptr(hash & uint64(b.n-1)))
+}
+
+func (b bucketArray) at(i uintptr) **mapEntry {
+	return (**mapEntry)(unsafe.Add(b.addr, i*unsafe.Sizeof(uintptr(0))))
+}
+
+// Map key/value为字节串的哈希表，桶数组、entry以及key/value的内容都在XMM内存中。
+// 扩容是渐进的：新桶数组分配后，之后的每次Put/Delete搬迁几个旧桶，不会出现单次很长的停顿。
+// Map不是并发安全的，Get/Range返回的内容指向XMM内存，在对应key被修改、删除或者Map被Free之前有效
+type Map struct {
+	m       xmm.XMemory
+	buckets bucketArray
+	old     bucketArray // 扩容中的旧桶数组，addr为nil表示没有在扩容
+	migrate uintptr     // 旧桶中下一个要搬迁的位置
+	count   int
+}
+
+// NewMap 创建Map，hint为预计的元素个数
+func NewMap(m xmm.XMemory, hint int) (*Map, error) {
+	if m == nil {
+		return nil, xmm.NilError
+	}
+	n := uintptr(mapMinBuckets)
+	for hint > 0 && n*mapLoadFactor < uintptr(hint) {
+		n <<= 1
+	}
+	mp := &Map{m: m}
+	var err error
+	if mp.buckets, err = mp.newBuckets(n); err != nil {
+		return nil, err
+	}
+	return mp, nil
+}
+
+func (mp *Map) newBuckets(n uintptr) (bucketArray, error) {
+	p, err := mp.m.Alloc(n * unsafe.Sizeof(uintptr(0)))
+	if err != nil {
+		return bucketArray{}, err
+	}
+	b := bucketArray{addr: p, n: n}
+	// 大于最大size class的分配不保证清零
+	for i := uintptr(0); i < n; i++ {
+		*b.at(i) = nil
+	}
+	return b, nil
+}
+
+// Len 元素个数
+func (mp *Map) Len() int {
+	return mp.count
+}
+
+// bucketOf hash所在的拉链：扩容中旧桶没有搬迁时在旧桶中
+func (mp *Map) bucketOf(hash uint64) **mapEntry {
+	if mp.old.addr != nil {
+		if slot := mp.old.slot(hash); *slot != nil {
+			return slot
+		}
+	}
+	return mp.buckets.slot(hash)
+}
+
+func (mp *Map) find(key []byte, hash uint64) *mapEntry {
+	for e := *mp.bucketOf(hash); e != nil; e = e.next {
+		if e.hash == hash && string(e.key()) == string(key) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Get 返回key对应的value
+func (mp *Map) Get(key []byte) ([]byte, bool) {
+	if mp.m == nil {
+		return nil, false
+	}
+	e := mp.find(key, hashBytes(key))
+	if e == nil {
+		return nil, false
+	}
+	return e.value(), true
+}
+
+// GetString 返回key对应的value，value指向XMM内存
+func (mp *Map) GetString(key string) (string, bool) {
+	if mp.m == nil {
+		return "", false
+	}
+	e := mp.find(stringBytes(key), hashBytes(stringBytes(key)))
+	if e == nil {
+		return "", false
+	}
+	return stringAt(unsafe.Add(unsafe.Pointer(e), mapEntrySize+uintptr(e.keyLen)), uintptr(e.valLen)), true
+}
+
+// Has key是否存在
+func (mp *Map) Has(key []byte) bool {
+	_, ok := mp.Get(key)
+	return ok
+}
+
+// checkEntrySize entry中key和value的长度用uint32保存
+func checkEntrySize(keyLen, valLen uint64) error {
+	if keyLen > 1<<32-1 || valLen > 1<<32-1 {
+		return MapEntryTooLargeError
+	}
+	return nil
+}
+
+// Put 把key和value拷贝到XMM内存中，key已经存在时替换value并释放旧的entry
+func (mp *Map) Put(key, value []byte) error {
+	if mp.m == nil {
+		return MapFreedError
+	}
+	if err := checkEntrySize(uint64(len(key)), uint64(len(value))); err != nil {
+		return err
+	}
+	hash := hashBytes(key)
+	if err := mp.step(hash); err != nil {
+		return err
+	}
+	p, err := mp.m.Alloc(mapEntrySize + uintptr(len(key)) + uintptr(len(value)))
+	if err != nil {
+		return err
+	}
+	e := (*mapEntry)(p)
+	e.hash, e.keyLen, e.valLen = hash, uint32(len(key)), uint32(len(value))
+	copy(e.key(), key)
+	copy(e.value(), value)
+
+	slot := mp.buckets.slot(hash)
+	for pp := slot; *pp != nil; pp = &(*pp).next {
+		old := *pp
+		if old.hash == hash && string(old.key()) == string(key) {
+			e.next = old.next
+			*pp = e
+			return mp.m.Free(uintptr(unsafe.Pointer(old)))
+		}
+	}
+	e.next = *slot
+	*slot = e
+	mp.count++
+	if mp.old.addr == nil && uintptr(mp.count) > mp.buckets.n*mapLoadFactor {
+		// 插入已经完成，扩容失败只是拉链变长，下次Put时重试
+		_ = mp.grow()
+	}
+	return nil
+}
+
+// PutString 同Put
+func (mp *Map) PutString(key, value string) error {
+	return mp.Put(stringBytes(key), stringBytes(value))
+}
+
+// Delete 删除key并释放其内存，返回key是否存在
+func (mp *Map) Delete(key []byte) (bool, error) {
+	if mp.m == nil {
+		return false, MapFreedError
+	}
+	hash := hashBytes(key)
+	if err := mp.step(hash); err != nil {
+		return false, err
+	}
+	for pp := mp.buckets.slot(hash); *pp != nil; pp = &(*pp).next {
+		e := *pp
+		if e.hash == hash && string(e.key()) == string(key) {
+			*pp = e.next
+			mp.count--
+			return true, mp.m.Free(uintptr(unsafe.Pointer(e)))
+		}
+	}
+	return false, nil
+}
+
+// DeleteString 同Delete
+func (mp *Map) DeleteString(key string) (bool, error) {
+	return mp.Delete(stringBytes(key))
+}
+
+// grow 分配两倍的新桶数组，旧桶在之后的操作中逐步搬迁
+func (mp *Map) grow() error {
+	buckets, err := mp.newBuckets(mp.buckets.n << 1)
+	if err != nil {
+		return err
+	}
+	mp.old, mp.buckets, mp.migrate = mp.buckets, buckets, 0
+	return nil
+}
+
+// step 扩容中时搬迁hash所在的旧桶以及mapEvacuateStep个旧桶，之后hash的拉链一定在新桶中
+func (mp *Map) step(hash uint64) error {
+	if mp.old.addr == nil {
+		return nil
+	}
+	mp.evacuate(mp.old.slot(hash))
+	for i := 0; i < mapEvacuateStep && mp.migrate < mp.old.n; i++ {
+		mp.evacuate(mp.old.at(mp.migrate))
+		mp.migrate++
+	}
+	if mp.migrate < mp.old.n {
+		return nil
+	}
+	old := mp.old
+	mp.old = bucketArray{}
+	return mp.m.Free(uintptr(old.addr))
+}
+
+// evacuate 把一个旧桶的拉链搬到新桶中
+func (mp *Map) evacuate(slot **mapEntry) {
+	for e := *slot; e != nil; {
+		next := e.next
+		dst := mp.buckets.slot(e.hash)
+		e.next = *dst
+		*dst = e
+		e = next
+	}
+	*slot = nil
+}
+
+// Range 遍历所有元素，fn返回false时停止。遍历期间不能修改Map
+func (mp *Map) Range(fn func(key, value []byte) bool) {
+	if mp.m == nil {
+		return
+	}
+	for _, b := range []bucketArray{mp.old, mp.buckets} {
+		for i := uintptr(0); b.addr != nil && i < b.n; i++ {
+			for e := *b.at(i); e != nil; {
+				next := e.next
+				if !fn(e.key(), e.value()) {
+					return
+				}
+				e = next
+			}
+		}
+	}
+}
+
+// Free 释放所有entry和桶数组，之后Map不能再使用
+func (mp *Map) Free() error {
+	if mp.m == nil {
+		return nil
+	}
+	var err error
+	for _, b := range []bucketArray{mp.old, mp.buckets} {
+		if b.addr == nil {
+			continue
+		}
+		for i := uintptr(0); i < b.n; i++ {
+			for e := *b.at(i); e != nil; {
+				next := e.next
+				if fe := mp.m.Free(uintptr(unsafe.Pointer(e))); fe != nil && err == nil {
+					err = fe
+				}
+				e = next
+			}
+		}
+		if e := mp.m.Free(uintptr(b.addr)); e != nil && err == nil {
+			err = e
+		}
+	}
+	mp.m, mp.buckets, mp.old, mp.count = nil, bucketArray{}, bucketArray{}, 0
+	return err
+}
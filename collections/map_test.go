@@ -0,0 +1,202 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package collections
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"unsafe"
+
+	"github.com/heiyeluren/xmm"
+)
+
+func newTestMemory(t testing.TB) xmm.XMemory {
+	f := &xmm.Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMap(t *testing.T) {
+	mp, err := NewMap(newTestMemory(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200000; i++ {
+		k := fmt.Sprintf("key-%d", r.Intn(50000))
+		switch r.Intn(4) {
+		case 0:
+			ok, err := mp.DeleteString(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, has := want[k]; has != ok {
+				t.Fatal("delete", k, ok)
+			}
+			delete(want, k)
+		default:
+			v := fmt.Sprintf("value-%d-%s", i, k[:r.Intn(len(k))])
+			if err := mp.PutString(k, v); err != nil {
+				t.Fatal(err)
+			}
+			want[k] = v
+		}
+		if mp.Len() != len(want) {
+			t.Fatal("len", mp.Len(), len(want))
+		}
+	}
+	for k, v := range want {
+		if got, ok := mp.GetString(k); !ok || got != v {
+			t.Fatal("get", k, got, v)
+		}
+		if got, ok := mp.Get([]byte(k)); !ok || string(got) != v {
+			t.Fatal("get bytes", k, got, v)
+		}
+	}
+	if _, ok := mp.GetString("missing"); ok {
+		t.Fatal("missing key")
+	}
+	seen := 0
+	mp.Range(func(key, value []byte) bool {
+		if want[string(key)] != string(value) {
+			t.Fatal("range", string(key))
+		}
+		seen++
+		return true
+	})
+	if seen != len(want) {
+		t.Fatal("range count", seen, len(want))
+	}
+	if err := mp.Free(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.PutString("a", "b"); err != MapFreedError {
+		t.Fatal(err)
+	}
+}
+
+func TestMapGrowIncremental(t *testing.T) {
+	mp, err := NewMap(newTestMemory(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 扩容开始后旧桶逐步搬迁，期间的查找、更新、删除都要正确
+	for i := 0; i < 10000; i++ {
+		if err := mp.Put([]byte(fmt.Sprint(i)), []byte(fmt.Sprint(i*2))); err != nil {
+			t.Fatal(err)
+		}
+		if mp.old.addr != nil {
+			for j := 0; j <= i; j += 97 {
+				if v, ok := mp.Get([]byte(fmt.Sprint(j))); !ok || string(v) != fmt.Sprint(j*2) {
+					t.Fatal("get during grow", j, string(v))
+				}
+			}
+		}
+	}
+	if mp.buckets.n*mapLoadFactor < 10000 {
+		t.Fatal("not grown", mp.buckets.n)
+	}
+	for i := 0; i < 10000; i += 2 {
+		if ok, err := mp.Delete([]byte(fmt.Sprint(i))); !ok || err != nil {
+			t.Fatal("delete", i, err)
+		}
+	}
+	if mp.Len() != 5000 {
+		t.Fatal(mp.Len())
+	}
+	for i := 0; i < 10000; i++ {
+		if _, ok := mp.Get([]byte(fmt.Sprint(i))); ok != (i%2 == 1) {
+			t.Fatal("get", i, ok)
+		}
+	}
+	if err := mp.Free(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingMemory 开启fail后大于等于failSize的分配失败
+type failingMemory struct {
+	xmm.XMemory
+	fail     bool
+	failSize uintptr
+}
+
+func (m *failingMemory) Alloc(size uintptr) (unsafe.Pointer, error) {
+	if m.fail && size >= m.failSize {
+		return nil, errors.New("alloc failed")
+	}
+	return m.XMemory.Alloc(size)
+}
+
+func TestCheckEntrySize(t *testing.T) {
+	for _, c := range []struct {
+		keyLen, valLen uint64
+		err            error
+	}{
+		{0, 0, nil},
+		{1<<32 - 1, 1<<32 - 1, nil},
+		{1 << 32, 0, MapEntryTooLargeError},
+		{0, 1 << 32, MapEntryTooLargeError},
+	} {
+		if err := checkEntrySize(c.keyLen, c.valLen); err != c.err {
+			t.Fatal(c.keyLen, c.valLen, err)
+		}
+	}
+}
+
+func TestMapPutErrors(t *testing.T) {
+	m := &failingMemory{XMemory: newTestMemory(t), failSize: 2 * mapMinBuckets * unsafe.Sizeof(uintptr(0))}
+	mp, err := NewMap(m, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 扩容失败时插入仍然成功
+	m.fail = true
+	n := mapMinBuckets*mapLoadFactor + 5
+	for i := 0; i < n; i++ {
+		if err := mp.PutString(fmt.Sprint(i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mp.Len() != n || mp.buckets.n != mapMinBuckets || mp.old.addr != nil {
+		t.Fatal(mp.Len(), mp.buckets.n)
+	}
+	// 下次Put时重试扩容
+	m.fail = false
+	if err := mp.PutString("next", "next"); err != nil {
+		t.Fatal(err)
+	}
+	if mp.buckets.n != 2*mapMinBuckets {
+		t.Fatal(mp.buckets.n)
+	}
+	for i := 0; i < n; i++ {
+		if v, ok := mp.GetString(fmt.Sprint(i)); !ok || v != fmt.Sprint(i) {
+			t.Fatal(i, v, ok)
+		}
+	}
+	if err := mp.Free(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -185,6 +185,21 @@ func (list *mSpanList) move(span *xSpan) {
 	}
 }
 
+// remove 从链表中删除span，span不在链表中时返回false
+func (list *mSpanList) remove(span *xSpan) bool {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	addr := (*unsafe.Pointer)(unsafe.Pointer(&list.first))
+	for node := list.first; node != nil; node = node.next {
+		if node == span {
+			atomic.StorePointer(addr, unsafe.Pointer(span.next))
+			return true
+		}
+		addr = (*unsafe.Pointer)(unsafe.Pointer(&node.next))
+	}
+	return false
+}
+
 func (list *mSpanList) foreach(consumer func(span *xSpan)) {
 	for node := list.first; node != nil; node = node.next {
 		consumer(node)
@@ -0,0 +1,397 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+const (
+	DefaultConcurrentMapShards = 32
+
+	cmMinBuckets = 16
+	// cmLoadFactor 分片中平均每个桶的entry数超过cmLoadFactor时扩容
+	cmLoadFactor = 2
+)
+
+var ConcurrentMapFreedError = errors.New("concurrent map is freed")
+
+var ConcurrentMapEntryTooLargeError = errors.New("key or value is larger than 4GiB")
+
+// cmEntry 拉链中的一项，key和value由Copy2分配在一起，key在前。
+// next和桶都指向XMM内存，GC不会扫描也不会回收
+type cmEntry struct {
+	next   *cmEntry
+	hash   uint64
+	data   uintptr
+	keyLen uint32
+	valLen uint32
+}
+
+func (e *cmEntry) key() []byte {
+	return rawBytes(e.data, uintptr(e.keyLen))
+}
+
+func (e *cmEntry) value() []byte {
+	return rawBytes(e.data+uintptr(e.keyLen), uintptr(e.valLen))
+}
+
+// cmShard 一个分片，读写锁保护，entry只在写锁下释放
+type cmShard struct {
+	lock    sync.RWMutex
+	buckets unsafe.Pointer // XMM中的桶数组，每个桶是拉链头entry
+	n       uintptr        // 桶数，2的幂
+	count   int
+	_       [40]byte // 避免相邻分片的false sharing
+}
+
+func bucketAt(buckets unsafe.Pointer, i uintptr) **cmEntry {
+	return (**cmEntry)(unsafe.Add(buckets, i*unsafe.Sizeof(uintptr(0))))
+}
+
+func (s *cmShard) bucket(hash uint64) **cmEntry {
+	return bucketAt(s.buckets, uintptr(hash&uint64(s.n-1)))
+}
+
+func (s *cmShard) find(key []byte, hash uint64) *cmEntry {
+	for e := *s.bucket(hash); e != nil; e = e.next {
+		if e.hash == hash && string(e.key()) == string(key) {
+			return e
+		}
+	}
+	return nil
+}
+
+// ConcurrentMap 并发安全的分片哈希表，桶、entry以及key/value都分配在XMM内存中，用于替代sync.Map以避免GC扫描。
+// 使用newXConcurrentHashMapSpanPool创建的专用spanPool，小对象class使用更大的span。
+// 读操作持有分片读锁并把value拷贝出来，删除和替换只在写锁下释放内存，因此并发读取不会访问到已经释放的entry。
+// 专用spanPool中的对象不会出现在Walk、Snapshot、Compact中
+type ConcurrentMap struct {
+	sp     *xSpanPool
+	shards []cmShard
+	freed  bool
+}
+
+// NewConcurrentMap 创建ConcurrentMap，shards为分片数(向上取2的幂)，0为DefaultConcurrentMapShards
+func NewConcurrentMap(m XMemory, shards int) (*ConcurrentMap, error) {
+	mem, ok := m.(*mm)
+	if !ok || shards < 0 {
+		return nil, NilError
+	}
+	if shards == 0 {
+		shards = DefaultConcurrentMapShards
+	}
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	spanFact := float32(0.75)
+	if pool, ok := mem.sp.(*xSpanPool); ok {
+		spanFact = pool.spanFact
+	}
+	sp, err := newXConcurrentHashMapSpanPool(mem.h, spanFact, 1)
+	if err != nil {
+		return nil, err
+	}
+	cm := &ConcurrentMap{sp: sp, shards: make([]cmShard, n)}
+	for i := range cm.shards {
+		if err := cm.resize(&cm.shards[i], cmMinBuckets); err != nil {
+			for j := 0; j < i; j++ {
+				sp.Free(uintptr(cm.shards[j].buckets))
+			}
+			sp.release()
+			return nil, err
+		}
+	}
+	return cm, nil
+}
+
+func cmHash(b []byte) uint64 {
+	h := uint64(fnvOffset64)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= fnvPrime64
+	}
+	return h
+}
+
+// shard 高位选分片，低位选桶
+func (cm *ConcurrentMap) shard(hash uint64) *cmShard {
+	return &cm.shards[(hash>>32)&uint64(len(cm.shards)-1)]
+}
+
+// resize 分配n个桶并把原有的entry搬过去，需要持有写锁
+func (cm *ConcurrentMap) resize(s *cmShard, n uintptr) error {
+	p, err := cm.sp.Alloc(n * unsafe.Sizeof(uintptr(0)))
+	if err != nil {
+		return err
+	}
+	// 大于最大size class的分配不清零
+	clearBytes(uintptr(p), n*unsafe.Sizeof(uintptr(0)))
+	old, oldN := s.buckets, s.n
+	s.buckets, s.n = p, n
+	if old == nil {
+		return nil
+	}
+	for i := uintptr(0); i < oldN; i++ {
+		for e := *bucketAt(old, i); e != nil; {
+			next := e.next
+			dst := s.bucket(e.hash)
+			e.next = *dst
+			*dst = e
+			e = next
+		}
+	}
+	return cm.sp.Free(uintptr(old))
+}
+
+// newEntry 分配entry，key和value通过Copy2拷贝到一起
+func (cm *ConcurrentMap) newEntry(key, value []byte, hash uint64) (*cmEntry, error) {
+	if uint64(len(key)) > 1<<32-1 || uint64(len(value)) > 1<<32-1 {
+		return nil, ConcurrentMapEntryTooLargeError
+	}
+	k, _, err := cm.sp.Copy2(key, value)
+	if err != nil {
+		return nil, err
+	}
+	p, err := cm.sp.Alloc(unsafe.Sizeof(cmEntry{}))
+	if err != nil {
+		if len(key)+len(value) > 0 {
+			cm.sp.Free(bytesData(k))
+		}
+		return nil, err
+	}
+	e := (*cmEntry)(p)
+	e.next, e.hash, e.keyLen, e.valLen = nil, hash, uint32(len(key)), uint32(len(value))
+	if len(key)+len(value) > 0 {
+		e.data = bytesData(k)
+	}
+	return e, nil
+}
+
+func bytesData(b []byte) uintptr {
+	return (*reflect.SliceHeader)(unsafe.Pointer(&b)).Data
+}
+
+// freeEntry 释放entry以及key/value，需要持有写锁
+func (cm *ConcurrentMap) freeEntry(e *cmEntry) error {
+	if e.data != 0 {
+		if err := cm.sp.Free(e.data); err != nil {
+			return err
+		}
+	}
+	return cm.sp.Free(uintptr(unsafe.Pointer(e)))
+}
+
+// insert 把新entry挂到桶上，需要持有写锁
+func (cm *ConcurrentMap) insert(s *cmShard, e *cmEntry) error {
+	slot := s.bucket(e.hash)
+	e.next = *slot
+	*slot = e
+	s.count++
+	if uintptr(s.count) > s.n*cmLoadFactor {
+		// 插入已经完成，扩容失败只是拉链变长，下次插入时重试
+		_ = cm.resize(s, s.n<<1)
+	}
+	return nil
+}
+
+// replace 用新entry替换old，释放old，需要持有写锁
+func (cm *ConcurrentMap) replace(s *cmShard, old, e *cmEntry) error {
+	for pp := s.bucket(old.hash); *pp != nil; pp = &(*pp).next {
+		if *pp == old {
+			e.next = old.next
+			*pp = e
+			return cm.freeEntry(old)
+		}
+	}
+	return nil
+}
+
+func cloneBytes(b []byte) []byte {
+	return append(make([]byte, 0, len(b)), b...)
+}
+
+// Load 返回key对应value的拷贝
+func (cm *ConcurrentMap) Load(key []byte) ([]byte, bool) {
+	hash := cmHash(key)
+	s := cm.shard(hash)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if cm.freed {
+		return nil, false
+	}
+	if e := s.find(key, hash); e != nil {
+		return cloneBytes(e.value()), true
+	}
+	return nil, false
+}
+
+// Store 保存key/value，key已经存在时替换并释放旧的entry
+func (cm *ConcurrentMap) Store(key, value []byte) error {
+	hash := cmHash(key)
+	s := cm.shard(hash)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cm.freed {
+		return ConcurrentMapFreedError
+	}
+	e, err := cm.newEntry(key, value, hash)
+	if err != nil {
+		return err
+	}
+	if old := s.find(key, hash); old != nil {
+		return cm.replace(s, old, e)
+	}
+	return cm.insert(s, e)
+}
+
+// LoadOrStore key存在时返回已有value的拷贝和true，否则保存value并返回value和false
+func (cm *ConcurrentMap) LoadOrStore(key, value []byte) (actual []byte, loaded bool, err error) {
+	hash := cmHash(key)
+	s := cm.shard(hash)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cm.freed {
+		return nil, false, ConcurrentMapFreedError
+	}
+	if old := s.find(key, hash); old != nil {
+		return cloneBytes(old.value()), true, nil
+	}
+	e, err := cm.newEntry(key, value, hash)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, false, cm.insert(s, e)
+}
+
+// CompareAndSwap key的value等于old时替换为new
+func (cm *ConcurrentMap) CompareAndSwap(key, old, new []byte) (bool, error) {
+	hash := cmHash(key)
+	s := cm.shard(hash)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cm.freed {
+		return false, ConcurrentMapFreedError
+	}
+	cur := s.find(key, hash)
+	if cur == nil || string(cur.value()) != string(old) {
+		return false, nil
+	}
+	e, err := cm.newEntry(key, new, hash)
+	if err != nil {
+		return false, err
+	}
+	return true, cm.replace(s, cur, e)
+}
+
+// Delete 删除key并释放其内存，返回key是否存在
+func (cm *ConcurrentMap) Delete(key []byte) (bool, error) {
+	hash := cmHash(key)
+	s := cm.shard(hash)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cm.freed {
+		return false, ConcurrentMapFreedError
+	}
+	for pp := s.bucket(hash); *pp != nil; pp = &(*pp).next {
+		e := *pp
+		if e.hash == hash && string(e.key()) == string(key) {
+			*pp = e.next
+			s.count--
+			return true, cm.freeEntry(e)
+		}
+	}
+	return false, nil
+}
+
+// Range 遍历所有元素，fn返回false时停止。每个分片在读锁下拷贝出来后再回调，fn中可以修改ConcurrentMap，
+// 和sync.Map一样不保证看到遍历期间的修改
+func (cm *ConcurrentMap) Range(fn func(key, value []byte) bool) {
+	var kvs [][2][]byte
+	for i := range cm.shards {
+		s := &cm.shards[i]
+		kvs = kvs[:0]
+		s.lock.RLock()
+		if cm.freed {
+			s.lock.RUnlock()
+			return
+		}
+		for b := uintptr(0); b < s.n; b++ {
+			for e := *bucketAt(s.buckets, b); e != nil; e = e.next {
+				kvs = append(kvs, [2][]byte{cloneBytes(e.key()), cloneBytes(e.value())})
+			}
+		}
+		s.lock.RUnlock()
+		for _, kv := range kvs {
+			if !fn(kv[0], kv[1]) {
+				return
+			}
+		}
+	}
+}
+
+// Len 元素个数
+func (cm *ConcurrentMap) Len() int {
+	n := 0
+	for i := range cm.shards {
+		s := &cm.shards[i]
+		s.lock.RLock()
+		n += s.count
+		s.lock.RUnlock()
+	}
+	return n
+}
+
+// Free 释放所有entry、桶数组以及专用spanPool的span，之后ConcurrentMap不能再使用
+func (cm *ConcurrentMap) Free() error {
+	for i := range cm.shards {
+		cm.shards[i].lock.Lock()
+		defer cm.shards[i].lock.Unlock()
+	}
+	if cm.freed {
+		return nil
+	}
+	cm.freed = true
+	var err error
+	for i := range cm.shards {
+		s := &cm.shards[i]
+		for b := uintptr(0); b < s.n; b++ {
+			for e := *bucketAt(s.buckets, b); e != nil; {
+				next := e.next
+				if fe := cm.freeEntry(e); fe != nil && err == nil {
+					err = fe
+				}
+				e = next
+			}
+		}
+		if e := cm.sp.Free(uintptr(s.buckets)); e != nil && err == nil {
+			err = e
+		}
+		s.buckets, s.n, s.count = nil, 0, 0
+	}
+	// 专用spanPool的span不在任何链表中，不还回去会一直占用
+	if e := cm.sp.release(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentMap(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, err := NewConcurrentMap(m, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, loaded, err := cm.LoadOrStore([]byte("a"), []byte("1"))
+	if err != nil || loaded || string(v) != "1" {
+		t.Fatal(string(v), loaded, err)
+	}
+	v, loaded, err = cm.LoadOrStore([]byte("a"), []byte("2"))
+	if err != nil || !loaded || string(v) != "1" {
+		t.Fatal(string(v), loaded, err)
+	}
+	if ok, err := cm.CompareAndSwap([]byte("a"), []byte("2"), []byte("3")); ok || err != nil {
+		t.Fatal("cas with wrong old", ok, err)
+	}
+	if ok, err := cm.CompareAndSwap([]byte("a"), []byte("1"), []byte("3")); !ok || err != nil {
+		t.Fatal("cas", ok, err)
+	}
+	if v, ok := cm.Load([]byte("a")); !ok || string(v) != "3" {
+		t.Fatal(string(v), ok)
+	}
+	// 小对象class使用更大的span
+	s := cm.shard(cmHash([]byte("a")))
+	e := s.find([]byte("a"), cmHash([]byte("a")))
+	span, err := m.(*mm).h.spanOf(e.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class := m.(*mm).h.classes.sizeToClass(8); span.classIndex != uint(class) || span.npages != m.(*mm).h.classes.spanPages(int(class))*10 {
+		t.Fatal("span pages", span.classIndex, span.npages)
+	}
+	if ok, err := cm.Delete([]byte("a")); !ok || err != nil {
+		t.Fatal("delete", ok, err)
+	}
+	if _, ok := cm.Load([]byte("a")); ok || cm.Len() != 0 {
+		t.Fatal("deleted")
+	}
+
+	const workers, keys = 8, 5000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				k := []byte(fmt.Sprintf("k-%d-%d", w, i))
+				if err := cm.Store(k, k); err != nil {
+					t.Error(err)
+					return
+				}
+				if v, ok := cm.Load(k); !ok || string(v) != string(k) {
+					t.Error("load", string(k), string(v))
+					return
+				}
+				if i%3 == 0 {
+					if ok, err := cm.Delete(k); !ok || err != nil {
+						t.Error("delete", string(k), err)
+						return
+					}
+				}
+			}
+		}(w)
+		// 并发读取其他worker的key，读到的value要么不存在要么完整
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				k := []byte(fmt.Sprintf("k-%d-%d", (w+1)%workers, i))
+				if v, ok := cm.Load(k); ok && string(v) != string(k) {
+					t.Error("torn read", string(k), string(v))
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	want := workers * (keys - (keys+2)/3)
+	if cm.Len() != want {
+		t.Fatal("len", cm.Len(), want)
+	}
+	n := 0
+	cm.Range(func(key, value []byte) bool {
+		if string(key) != string(value) {
+			t.Fatal(string(key), string(value))
+		}
+		// Range的回调中可以修改
+		if _, err := cm.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		return true
+	})
+	if n != want || cm.Len() != 0 {
+		t.Fatal("range", n, cm.Len())
+	}
+	if err := cm.Free(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Store([]byte("a"), nil); err != ConcurrentMapFreedError {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentMapFreeReleasesSpans(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, err := NewConcurrentMap(m, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprint(i))
+		if err := cm.Store(k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var spans []*xSpan
+	for class := range cm.sp.spans {
+		s, _ := cm.sp.getSpan(uint8(class))
+		spans = append(spans, s...)
+	}
+	if len(spans) == 0 {
+		t.Fatal("no span in use")
+	}
+	if err := cm.Free(); err != nil {
+		t.Fatal(err)
+	}
+	h := m.(*mm).h
+	for _, span := range spans {
+		if s, err := h.spanOf(span.startAddr); err != nil || s != nil {
+			t.Fatal("span is not released", s, err)
+		}
+	}
+	if err := cm.sp.growSpan(1, ExpendSync, 0); err != SpanPoolReleasedError {
+		t.Fatal(err)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// 还回去的页可以再分配
+	if _, err := m.Alloc(8); err != nil {
+		t.Fatal(err)
+	}
+}
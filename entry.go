@@ -18,8 +18,16 @@ License.
 // Package xmm
 // Package redblacktree provides a pure Golang implementation
 // of a red-black tree as described by Thomas H. Cormen's et al.
-// in their seminal Algorithms book (3rd ed). This data structure
-// is not multi-goroutine safe.
+// in their seminal Algorithms book (3rd ed).
+//
+// Concurrency: every public Tree method is safe for concurrent use.
+// Writers (Put, PutKV, Delete, DeleteKV, Free, Rotate*, SetComparator) hold the
+// write lock; readers (Get, Has, GetParent, Size, Walk, Min, Max, Floor, Ceiling,
+// iterators) share the read lock and never block each other. Visitors passed to
+// Walk run under the read lock and must not call any Tree method: taking the read
+// lock again deadlocks once a writer is waiting. Nodes returned to the caller are
+// only stable until the next write. Snapshot offers a lock-free read path on an
+// immutable copy that costs O(n) to rebuild after each write, see tree_snapshot.go.
 package xmm
 
 import (
@@ -33,6 +41,8 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 type NodeEntry struct {
@@ -47,40 +57,6 @@ type NodeEntry struct {
 	color  Color // 比二叉查找树要多出一个颜色属性
 }
 
-type encodedNodeEntry struct {
-	TotalLen uint64
-	KeyLen   uint64
-	ValueLen uint64
-	Hash     uint64
-	Next     *NodeEntry
-
-	right  *NodeEntry
-	left   *NodeEntry
-	parent *NodeEntry
-	color  Color // 比二叉查找树要多出一个颜色属性
-
-	// 追加string  key、value 要不然就内存泄露了
-
-}
-
-/*// total'len(64) + key'len(64) + key'content +
-func (n *NodeEntry) encode() []byte {
-	var keyLen, valLen = round(uint64(len(n.Key)), 8), round(uint64(len(n.Value)), 8)
-	total := keyLen + valLen + 8*8
-	encoded := encodedNodeEntry{
-		TotalLen: total,
-		KeyLen:   keyLen,
-		ValueLen: valLen,
-		Hash:     0,
-		Next:     nil,
-		right:    nil,
-		left:     nil,
-		parent:   nil,
-		color:    false,
-	}
-
-}*/
-
 // BytesAscSort is a helper function for sorting a slice of byte slices
 var BytesAscSort Comparator = func(o1, o2 interface{}) int {
 	key1, key2 := o1.([]byte), o2.([]byte)
@@ -196,10 +172,16 @@ func StringComparator(o1, o2 interface{}) int {
 }
 
 // Tree encapsulates the data structure.
+// A Tree created by NewTreeIn keeps its nodes, keys and values in XMM memory:
+// use PutKV to insert, and Delete/DeleteKV/Free to release the memory.
 type Tree struct {
 	root *NodeEntry // tip of the tree
 	cmp  Comparator // required function to order keys
 	lock sync.RWMutex
+	mem  XMemory // 不为nil时节点和key/value都分配在XMM中
+
+	modCount uint64       // 每次修改加1，迭代器据此发现并发修改
+	snapshot atomic.Value // *TreeSnapshot，写操作时清空，见Snapshot
 }
 
 // `lock` protects `logger`
@@ -239,8 +221,19 @@ func NewTreeWith(c Comparator) *Tree {
 	return &Tree{root: nil, cmp: c}
 }
 
+// NewTreeIn returns an empty Tree whose nodes, keys and values are allocated in `mem`.
+func NewTreeIn(mem XMemory, c Comparator) (*Tree, error) {
+	if mem == nil {
+		return nil, NilError
+	}
+	return &Tree{root: nil, cmp: c, mem: mem}, nil
+}
+
 func (t *Tree) SetComparator(c Comparator) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	t.cmp = c
+	t.modified()
 }
 
 // Get looks for the node with supplied key and returns its mapped payload.
@@ -250,6 +243,8 @@ func (t *Tree) Get(key []byte) (bool, []byte) {
 		// logger.Printf("Get was prematurely aborted: %s\n", err.Error())
 		return false, nil
 	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 	ok, node := t.getNode(key)
 	if ok {
 		return true, node.Value
@@ -258,8 +253,9 @@ func (t *Tree) Get(key []byte) (bool, []byte) {
 	}
 }
 
+// getNode looks for the node with supplied key, the caller must hold the lock.
 func (t *Tree) getNode(key interface{}) (bool, *NodeEntry) {
-	found, parent, dir := t.GetParent(key)
+	found, parent, dir := t.internalLookup(nil, t.root, key, NODIR)
 	if found {
 		if parent == nil {
 			return true, t.root
@@ -298,10 +294,6 @@ func (t *Tree) GetParent(key interface{}) (found bool, parent *NodeEntry, dir Di
 		// logger.Printf("GetParent was prematurely aborted: %s\n", err.Error())
 		return false, nil, NODIR
 	}
-
-	if t.root == nil {
-		return false, nil, NODIR
-	}
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 	return t.internalLookup(nil, t.root, key, NODIR)
@@ -324,6 +316,13 @@ func (t *Tree) internalLookup(parent *NodeEntry, this *NodeEntry, key interface{
 
 // RotateRight Reverses actions of RotateLeft
 func (t *Tree) RotateRight(y *NodeEntry) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.rotateRight(y)
+	t.modified()
+}
+
+func (t *Tree) rotateRight(y *NodeEntry) {
 	if y == nil {
 		// logger.Printf("RotateRight: nil arg cannot be rotated. Noop\n")
 		return
@@ -354,6 +353,13 @@ func (t *Tree) RotateRight(y *NodeEntry) {
 
 // RotateLeft Side-effect: red-black tree properties is maintained.
 func (t *Tree) RotateLeft(x *NodeEntry) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.rotateLeft(x)
+	t.modified()
+}
+
+func (t *Tree) rotateLeft(x *NodeEntry) {
 	if x == nil {
 		// logger.Printf("RotateLeft: nil arg cannot be rotated. Noop\n")
 		return
@@ -386,7 +392,11 @@ func (t *Tree) RotateLeft(x *NodeEntry) {
 // Put saves the mapping (key, data) into the tree.
 // If a mapping identified by `key` already exists, it is overwritten.
 // Constraint: Not everything can be a key.
+// Trees bound to an XMemory only accept PutKV.
 func (t *Tree) Put(node *NodeEntry) error {
+	if t.mem != nil {
+		return ErrorTreeInXmm
+	}
 	node.parent, node.left, node.Next, node.right = nil, nil, nil, nil
 	key, data := node.Key, node.Value
 	if err := mustBeValidKey(key); err != nil {
@@ -395,54 +405,105 @@ func (t *Tree) Put(node *NodeEntry) error {
 	}
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	if t.root == nil {
-		node.color = BLACK
-		t.root = node
-		// logger.Printf("Added %s as root node\n", t.root.String())
+	found, parent, dir := t.internalLookup(nil, t.root, key, NODIR)
+	if found {
+		// logger.Printf("Put: found. Overwriting\n")
+		t.child(parent, dir).Value = data
+		t.modified()
 		return nil
 	}
+	t.attach(node, parent, dir)
+	return nil
+}
 
+// PutKV saves the mapping (key, value) into the tree.
+// For trees bound to an XMemory, key and value are copied into XMM memory with Copy2
+// and the node is allocated with Alloc; an overwritten mapping frees its old key/value.
+func (t *Tree) PutKV(key, value []byte) error {
+	if t.mem == nil {
+		return t.Put(&NodeEntry{Key: key, Value: value})
+	}
+	if err := mustBeValidKey(key); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	found, parent, dir := t.internalLookup(nil, t.root, key, NODIR)
+	newKey, newValue, err := t.mem.Copy2(key, value)
+	if err != nil {
+		return err
+	}
 	if found {
-		if parent == nil {
-			// logger.Printf("Put: parent=nil & found. Overwrite ROOT node\n")
-			t.root.Value = data
-		} else {
-			// logger.Printf("Put: parent!=nil & found. Overwriting\n")
-			switch dir {
-			case LEFT:
-				parent.left.Value = data
-			case RIGHT:
-				parent.right.Value = data
-			}
-		}
-
-	} else {
-		if parent != nil {
-			node.parent = parent
-			newNode := node
-			switch dir {
-			case LEFT:
-				parent.left = newNode
-			case RIGHT:
-				parent.right = newNode
-			}
-			// logger.Printf("Added %s to %s node of parent %s\n", newNode.String(), dir, parent.String())
-			t.fixupPut(newNode)
-		}
+		node := t.child(parent, dir)
+		oldKey, oldValue := node.Key, node.Value
+		node.Key, node.Value = newKey, newValue
+		// 旧的key/value被释放，迭代器不能再使用
+		t.modified()
+		return t.freeKV(oldKey, oldValue)
+	}
+	p, err := t.mem.Alloc(unsafe.Sizeof(NodeEntry{}))
+	if err != nil {
+		t.freeKV(newKey, newValue)
+		return err
 	}
+	node := (*NodeEntry)(p)
+	node.Key, node.Value = newKey, newValue
+	t.attach(node, parent, dir)
 	return nil
 }
 
-func isRed(n *NodeEntry) bool {
-	key := reflect.ValueOf(n)
-	if key.IsNil() {
-		return false
-	} else {
-		return n.color == RED
+// child returns the node found by internalLookup.
+func (t *Tree) child(parent *NodeEntry, dir Direction) *NodeEntry {
+	switch {
+	case parent == nil:
+		return t.root
+	case dir == LEFT:
+		return parent.left
+	default:
+		return parent.right
 	}
 }
 
+// attach links a new node below parent (or as root) and rebalances.
+func (t *Tree) attach(node *NodeEntry, parent *NodeEntry, dir Direction) {
+	t.modified()
+	if parent == nil {
+		node.color = BLACK
+		t.root = node
+		// logger.Printf("Added %s as root node\n", t.root.String())
+		return
+	}
+	node.parent = parent
+	switch dir {
+	case LEFT:
+		parent.left = node
+	case RIGHT:
+		parent.right = node
+	}
+	// logger.Printf("Added %s to %s node of parent %s\n", node.String(), dir, parent.String())
+	t.fixupPut(node)
+}
+
+// freeKV frees key/value copied by Copy2 in PutKV.
+func (t *Tree) freeKV(key, value []byte) error {
+	if len(key)+len(value) == 0 {
+		return nil
+	}
+	return t.mem.FreeGroup((*reflect.SliceHeader)(unsafe.Pointer(&key)).Data)
+}
+
+// freeNode frees a node of a tree bound to an XMemory together with its key/value.
+func (t *Tree) freeNode(node *NodeEntry) error {
+	if err := t.freeKV(node.Key, node.Value); err != nil {
+		return err
+	}
+	return t.mem.Free(uintptr(unsafe.Pointer(node)))
+}
+
+func isRed(n *NodeEntry) bool {
+	return n != nil && n.color == RED
+}
+
 // fix possible violations of red-black-tree properties
 // with combinations of:
 // 1. recoloring
@@ -486,14 +547,14 @@ loop:
 						// case 2
 						// logger.Printf("\t\t(*) case 2\n")
 						z = z.parent
-						t.RotateLeft(z)
+						t.rotateLeft(z)
 					}
 
 					// case 3
 					// logger.Printf("\t\t(*) case 3\n")
 					z.parent.color = BLACK
 					grandparent.color = RED
-					t.RotateRight(grandparent)
+					t.rotateRight(grandparent)
 				}
 			} else {
 				// logger.Printf("\t\t%s is the right child of %s\n", z.parent, grandparent)
@@ -513,14 +574,14 @@ loop:
 						// case 2
 						// logger.Printf("\t\t..(*) case 2\n")
 						z = z.parent
-						t.RotateRight(z)
+						t.rotateRight(z)
 					}
 
 					// case 3
 					// logger.Printf("\t\t..(*) case 3\n")
 					z.parent.color = BLACK
 					grandparent.color = RED
-					t.RotateLeft(grandparent)
+					t.rotateLeft(grandparent)
 				}
 			}
 		}
@@ -530,8 +591,10 @@ loop:
 
 // Size returns the number of items in the tree.
 func (t *Tree) Size() uint64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 	visitor := &countingVisitor{}
-	t.Walk(visitor)
+	visitor.Visit(t.root)
 	return visitor.Count
 }
 
@@ -541,6 +604,8 @@ func (t *Tree) Has(key interface{}) bool {
 		// logger.Printf("Has was prematurely aborted: %s\n", err.Error())
 		return false
 	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 	found, _, _ := t.internalLookup(nil, t.root, key, NODIR)
 	return found
 }
@@ -560,28 +625,64 @@ func (t *Tree) transplant(u *NodeEntry, v *NodeEntry) {
 
 // Delete removes the item identified by the supplied key.
 // Delete is a noop if the supplied key doesn't exist.
+// For trees bound to an XMemory the removed node is freed and a detached copy of it (Key/Value copied
+// to the Go heap) is returned; a free error is only logged, use DeleteKV to get it.
 func (t *Tree) Delete(key []byte) *NodeEntry {
-	if !t.Has(key) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	z := t.delete(key)
+	if z == nil || t.mem == nil {
+		return z
+	}
+	removed := &NodeEntry{
+		Key:   append([]byte(nil), z.Key...),
+		Value: append([]byte(nil), z.Value...),
+		Hash:  z.Hash,
+	}
+	if err := t.freeNode(z); err != nil {
+		log.Printf("Delete: free node err: %s\n", err)
+	}
+	return removed
+}
+
+// DeleteKV removes the item identified by the supplied key and reports whether it existed.
+// For trees bound to an XMemory the node and its key/value are freed.
+func (t *Tree) DeleteKV(key []byte) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	z := t.delete(key)
+	if z == nil {
+		return false, nil
+	}
+	if t.mem == nil {
+		return true, nil
+	}
+	return true, t.freeNode(z)
+}
+
+// delete unlinks the node with supplied key, the caller must hold the write lock.
+func (t *Tree) delete(key []byte) *NodeEntry {
+	found, z := t.getNode(key)
+	if !found {
 		// logger.Printf("Delete: bail as no node exists for key %d\n", key)
 		return nil
 	}
-	_, z := t.getNode(key)
+	t.modified()
 	y := z
 	yOriginalColor := y.color
-	var x *NodeEntry
+	// x可能是nil，需要单独记录它的parent
+	var x, xParent *NodeEntry
 
 	if z.left == nil {
 		// one child (RIGHT)
 		// logger.Printf("\t\tDelete: case (a)\n")
-		x = z.right
-		// logger.Printf("\t\t\t--- x is right of z")
+		x, xParent = z.right, z.parent
 		t.transplant(z, z.right)
 
 	} else if z.right == nil {
 		// one child (LEFT)
 		// logger.Printf("\t\tDelete: case (b)\n")
-		x = z.left
-		// logger.Printf("\t\t\t--- x is left of z")
+		x, xParent = z.left, z.parent
 		t.transplant(z, z.left)
 
 	} else {
@@ -591,13 +692,11 @@ func (t *Tree) Delete(key []byte) *NodeEntry {
 		// logger.Printf("\t\t\tminimum of z.right is %s (color=%s)\n", y, y.color)
 		yOriginalColor = y.color
 		x = y.right
-		// logger.Printf("\t\t\t--- x is right of minimum")
 
 		if y.parent == z {
-			if x != nil {
-				x.parent = y
-			}
+			xParent = y
 		} else {
+			xParent = y.parent
 			t.transplant(y, y.right)
 			y.right = z.right
 			y.right.parent = y
@@ -608,113 +707,126 @@ func (t *Tree) Delete(key []byte) *NodeEntry {
 		y.color = z.color
 	}
 	if yOriginalColor == BLACK {
-		t.fixupDelete(x)
+		t.fixupDelete(x, xParent)
 	}
 	return z
 }
 
-func (t *Tree) fixupDelete(x *NodeEntry) {
+// fixupDelete restores the red-black properties after a black node was removed
+// above x. x may be nil (a leaf), so its parent is passed explicitly.
+func (t *Tree) fixupDelete(x *NodeEntry, parent *NodeEntry) {
 	// logger.Printf("\t\t\tfixupDelete of node %s\n", x)
-	if x == nil {
-		return
-	}
-loop:
-	for {
-		switch {
-		case x == t.root:
-			// logger.Printf("\t\t\t=> bye .. is root\n")
-			break loop
-		case x.color == RED:
-			// logger.Printf("\t\t\t=> bye .. RED\n")
-			break loop
-		case x == x.parent.right:
-			// logger.Printf("\t\tBRANCH: x is right child of parent\n")
-			w := x.parent.left // is nillable
+	for x != t.root && !isRed(x) {
+		if x == parent.left {
+			w := parent.right
 			if isRed(w) {
-				// Convert case 1 into case 2, 3, or 4
-				// logger.Printf("\t\t\tR> case 1\n")
+				// case 1 - convert into case 2, 3, or 4
 				w.color = BLACK
-				x.parent.color = RED
-				t.RotateRight(x.parent)
-				w = x.parent.left
+				parent.color = RED
+				t.rotateLeft(parent)
+				w = parent.right
 			}
-			if w != nil {
-				switch {
-				case !isRed(w.left) && !isRed(w.right):
-					// case 2 - both children of w are BLACK
-					// logger.Printf("\t\t\tR> case 2\n")
-					w.color = RED
-					x = x.parent // recurse up tree
-				case isRed(w.right) && !isRed(w.left):
-					// case 3 - right child RED & left child BLACK
-					// convert to case 4
-					// logger.Printf("\t\t\tR> case 3\n")
-					w.right.color = BLACK
-					w.color = RED
-					t.RotateLeft(w)
-					w = x.parent.left
-				}
-				if isRed(w.left) {
-					// case 4 - left child is RED
-					// logger.Printf("\t\t\tR> case 4\n")
-					w.color = x.parent.color
-					x.parent.color = BLACK
-					w.left.color = BLACK
-					t.RotateRight(x.parent)
-					x = t.root
-				}
+			if !isRed(w.left) && !isRed(w.right) {
+				// case 2 - both children of w are BLACK, recurse up tree
+				w.color = RED
+				x, parent = parent, parent.parent
+				continue
 			}
-		case x == x.parent.left:
-			// logger.Printf("\t\tBRANCH: x is left child of parent\n")
-			w := x.parent.right // is nillable
+			if !isRed(w.right) {
+				// case 3 - left child RED & right child BLACK, convert to case 4
+				w.left.color = BLACK
+				w.color = RED
+				t.rotateRight(w)
+				w = parent.right
+			}
+			// case 4 - right child is RED
+			w.color = parent.color
+			parent.color = BLACK
+			w.right.color = BLACK
+			t.rotateLeft(parent)
+			x = t.root
+		} else {
+			w := parent.left
 			if isRed(w) {
-				// Convert case 1 into case 2, 3, or 4
-				// logger.Printf("\t\t\tL> case 1\n")
 				w.color = BLACK
-				x.parent.color = RED
-				t.RotateLeft(x.parent)
-				w = x.parent.right
+				parent.color = RED
+				t.rotateRight(parent)
+				w = parent.left
 			}
-			if w != nil {
-				switch {
-				case !isRed(w.left) && !isRed(w.right):
-					// case 2 - both children of w are BLACK
-					// logger.Printf("\t\t\tL> case 2\n")
-					w.color = RED
-					x = x.parent // recurse up tree
-				case isRed(w.left) && !isRed(w.right):
-					// case 3 - left child RED & right child BLACK
-					// convert to case 4
-					// logger.Printf("\t\t\tL> case 3\n")
-					w.left.color = BLACK
-					w.color = RED
-					t.RotateRight(w)
-					w = x.parent.right
-				}
-				if isRed(w.right) {
-					// case 4 - right child is RED
-					// logger.Printf("\t\t\tL> case 4\n")
-					w.color = x.parent.color
-					x.parent.color = BLACK
-					w.right.color = BLACK
-					t.RotateLeft(x.parent)
-					x = t.root
-				}
+			if !isRed(w.left) && !isRed(w.right) {
+				w.color = RED
+				x, parent = parent, parent.parent
+				continue
 			}
+			if !isRed(w.left) {
+				w.right.color = BLACK
+				w.color = RED
+				t.rotateLeft(w)
+				w = parent.left
+			}
+			w.color = parent.color
+			parent.color = BLACK
+			w.left.color = BLACK
+			t.rotateRight(parent)
+			x = t.root
 		}
 	}
-	x.color = BLACK
+	if x != nil {
+		x.color = BLACK
+	}
 }
 
-// Walk accepts a Visitor
+// Free releases all nodes of a tree bound to an XMemory, leaving it empty.
+func (t *Tree) Free() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.mem == nil {
+		t.root = nil
+		t.modified()
+		return nil
+	}
+	var err error
+	// 后序释放，释放前先取出子节点
+	var free func(node *NodeEntry)
+	free = func(node *NodeEntry) {
+		if node == nil {
+			return
+		}
+		left, right := node.left, node.right
+		free(left)
+		free(right)
+		if e := t.freeNode(node); e != nil && err == nil {
+			err = e
+		}
+	}
+	free(t.root)
+	t.root = nil
+	t.modified()
+	return err
+}
+
+// Walk accepts a Visitor. The visitor runs under the read lock and must not call any
+// method of the tree (not even Get or Has), otherwise it may deadlock with a waiting writer.
+// Use Snapshot or an iterator to read the tree while visiting.
 func (t *Tree) Walk(visitor Visitor) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 	visitor.Visit(t.root)
 }
 
 func (t *Tree) GetRoot() *NodeEntry {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 	return t.root
 }
 
+// modified is called on every write under the write lock: iterators see
+// the new modCount and the published snapshot is dropped.
+func (t *Tree) modified() {
+	t.modCount++
+	t.snapshot.Store((*TreeSnapshot)(nil))
+}
+
 // countingVisitor counts the number
 // of nodes in the tree.
 type countingVisitor struct {
@@ -782,6 +894,7 @@ func (v *HookVisitor) Visit(node *NodeEntry) {
 var (
 	ErrorKeyIsNil      = errors.New("The literal nil not allowed as keys")
 	ErrorKeyDisallowed = errors.New("Disallowed key typsssssssse")
+	ErrorTreeInXmm     = errors.New("Tree is bound to XMemory, use PutKV")
 )
 
 // Allowed key types are: Boolean, Integer, Floating point, Complex, String values
@@ -0,0 +1,164 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"unsafe"
+)
+
+// checkTree 校验红黑树性质，返回节点数
+func checkTree(t *testing.T, tree *Tree) int {
+	var check func(n *NodeEntry) (blacks, count int)
+	check = func(n *NodeEntry) (int, int) {
+		if n == nil {
+			return 1, 0
+		}
+		if n.color == RED && (isRed(n.left) || isRed(n.right)) {
+			t.Fatal("red node has red child", string(n.Key))
+		}
+		for _, c := range []*NodeEntry{n.left, n.right} {
+			if c != nil && c.parent != n {
+				t.Fatal("bad parent", string(c.Key))
+			}
+		}
+		if n.left != nil && bytes.Compare(n.left.Key, n.Key) >= 0 || n.right != nil && bytes.Compare(n.right.Key, n.Key) <= 0 {
+			t.Fatal("out of order", string(n.Key))
+		}
+		lb, lc := check(n.left)
+		rb, rc := check(n.right)
+		if lb != rb {
+			t.Fatal("black height", string(n.Key))
+		}
+		if n.color == BLACK {
+			lb++
+		}
+		return lb, lc + rc + 1
+	}
+	if isRed(tree.root) {
+		t.Fatal("red root")
+	}
+	_, count := check(tree.root)
+	return count
+}
+
+func TestTreeInXmm(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTreeIn(m, BytesAscSort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put(&NodeEntry{Key: []byte("a")}); err != ErrorTreeInXmm {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		k := fmt.Sprintf("key-%05d", r.Intn(5000))
+		if r.Intn(3) == 0 {
+			ok, err := tree.DeleteKV([]byte(k))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, has := want[k]; has != ok {
+				t.Fatal("delete", k, ok)
+			}
+			delete(want, k)
+			continue
+		}
+		v := fmt.Sprintf("value-%d", i)
+		if err := tree.PutKV([]byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+	if n := checkTree(t, tree); n != len(want) || tree.Size() != uint64(len(want)) {
+		t.Fatal("size", n, len(want))
+	}
+	h := m.(*mm).h
+	for k, v := range want {
+		ok, got := tree.Get([]byte(k))
+		if !ok || string(got) != v {
+			t.Fatal("get", k, string(got), v)
+		}
+		_, node := tree.getNode([]byte(k))
+		// 节点和key/value都在XMM中
+		for _, addr := range []uintptr{uintptr(unsafe.Pointer(node)), uintptr(unsafe.Pointer(&node.Key[0])), uintptr(unsafe.Pointer(&node.Value[0]))} {
+			if span, err := h.spanOf(addr); err != nil || span == nil {
+				t.Fatal("not in xmm", k, err)
+			}
+		}
+	}
+	for k, v := range want {
+		node := tree.Delete([]byte(k))
+		if node == nil || string(node.Key) != k || string(node.Value) != v {
+			t.Fatal("delete", k, node)
+		}
+		// 返回的是Go堆中的拷贝，不引用已经释放的XMM内存
+		if span, _ := h.spanOf(uintptr(unsafe.Pointer(node))); span != nil {
+			t.Fatal("delete returns freed node")
+		}
+		if tree.Delete([]byte(k)) != nil {
+			t.Fatal("delete twice", k)
+		}
+		break
+	}
+	if err := tree.Free(); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Size() != 0 {
+		t.Fatal("not empty")
+	}
+	var live int
+	m.Walk(func(obj ObjectInfo) bool {
+		live++
+		return true
+	})
+	if live != 0 {
+		t.Fatal("live objects", live)
+	}
+}
+
+func TestTreeInGoHeap(t *testing.T) {
+	tree := NewTreeWith(BytesAscSort)
+	for i := 0; i < 1000; i++ {
+		if err := tree.PutKV([]byte(fmt.Sprintf("%04d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Put(&NodeEntry{Key: []byte("0001"), Value: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, v := tree.Get([]byte("0001")); !ok || string(v) != "x" {
+		t.Fatal(ok, string(v))
+	}
+	if node := tree.Delete([]byte("0002")); node == nil || string(node.Key) != "0002" {
+		t.Fatal(node)
+	}
+	if n := checkTree(t, tree); n != 999 {
+		t.Fatal(n)
+	}
+}
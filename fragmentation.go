@@ -0,0 +1,233 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// FragmentationReport 堆的碎片和利用率统计
+type FragmentationReport struct {
+	// Classes 下标为size class，0为大对象(包括RawAlloc)
+	Classes []ClassFragmentation
+
+	// FreeChunks treap中空闲chunk按页数的直方图，按Pages递增
+	FreeChunks []FreeChunkBucket
+
+	// Arenas 每个RawMemory(arena)的占用情况，按地址递增
+	Arenas []ArenaOccupancy
+
+	// SizesTracked 是否开启了Options.TrackSizes，未开启时RequestedBytes和InternalWaste为0
+	SizesTracked bool
+}
+
+// ClassFragmentation 一个size class的碎片统计
+type ClassFragmentation struct {
+	SizeClass      uint8
+	ClassSize      uintptr // 大对象为0
+	Objects        uintptr // 存活对象数
+	LiveBytes      uintptr // 存活对象占用的slot字节数
+	RequestedBytes uintptr // 存活对象请求的字节数
+	InternalWaste  uintptr // LiveBytes - RequestedBytes
+	ExternalWaste  uintptr // 部分使用的span中空闲slot的字节数
+	EmptySpans     int
+	PartialSpans   int
+	FullSpans      int
+}
+
+// FreeChunkBucket 页数在[Pages, 2*Pages)之间的空闲chunk
+type FreeChunkBucket struct {
+	Pages uintptr
+	Count int
+	Bytes uintptr
+}
+
+// ArenaOccupancy 一个arena的占用情况
+type ArenaOccupancy struct {
+	Base      uintptr
+	Size      uintptr
+	SpanBytes uintptr // 分配给span的字节数
+	LiveBytes uintptr // 存活对象占用的slot字节数
+	FreeBytes uintptr // treap中的空闲字节数
+}
+
+// Unused arena中既不属于span也不在treap中的字节数(还没有切分给堆)
+func (a ArenaOccupancy) Unused() uintptr {
+	return a.Size - a.SpanBytes - a.FreeBytes
+}
+
+func (r *FragmentationReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%5s %6s %9s %12s %12s %12s %12s %6s %8s %6s\n", "class", "size", "objects", "live", "requested",
+		"int.waste", "ext.waste", "empty", "partial", "full")
+	for _, c := range r.Classes {
+		if c.Objects == 0 && c.EmptySpans+c.PartialSpans+c.FullSpans == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "%5d %6d %9d %12d %12d %12d %12d %6d %8d %6d\n", c.SizeClass, c.ClassSize, c.Objects, c.LiveBytes,
+			c.RequestedBytes, c.InternalWaste, c.ExternalWaste, c.EmptySpans, c.PartialSpans, c.FullSpans)
+	}
+	b.WriteString("free chunks:\n")
+	for _, c := range r.FreeChunks {
+		fmt.Fprintf(&b, "\t[%d, %d) pages: %d chunks %d bytes\n", c.Pages, 2*c.Pages, c.Count, c.Bytes)
+	}
+	b.WriteString("arenas:\n")
+	for _, a := range r.Arenas {
+		fmt.Fprintf(&b, "\t%#x: span %d live %d free %d unused %d\n", a.Base, a.SpanBytes, a.LiveBytes, a.FreeBytes, a.Unused())
+	}
+	return b.String()
+}
+
+func (m *mm) FragmentationReport() *FragmentationReport {
+	r := &FragmentationReport{Classes: make([]ClassFragmentation, m.h.classes.num()), SizesTracked: m.h.opts.TrackSizes}
+	for i := range r.Classes {
+		r.Classes[i].SizeClass = uint8(i)
+		r.Classes[i].ClassSize = uintptr(m.h.classes.size[i])
+	}
+	arenas := make(map[RawMemoryIdx]*ArenaOccupancy)
+	for _, ai := range m.h.arenas() {
+		arenas[ai] = &ArenaOccupancy{Base: RawMemoryBase(ai), Size: heapRawMemoryBytes}
+	}
+	// 按arena切分[start, start+size)
+	perArena := func(start, size uintptr, fn func(a *ArenaOccupancy, n uintptr)) {
+		for end := start + size; start < end; {
+			ai := RawMemoryIndex(start)
+			n := RawMemoryBase(ai) + heapRawMemoryBytes - start
+			if n > end-start {
+				n = end - start
+			}
+			if a, ok := arenas[ai]; ok {
+				fn(a, n)
+			}
+			start += n
+		}
+	}
+
+	if sp, ok := m.sp.(*xSpanPool); ok {
+		_ = sp.foreachSpan(func(span *xSpan, kind spanKind) error {
+			c := &r.Classes[span.classIndex]
+			s := span.fragmentation(kind == spanRaw)
+			c.Objects += s.live
+			c.LiveBytes += s.live * s.slotSize
+			c.RequestedBytes += s.requested
+			switch {
+			case s.live == 0:
+				c.EmptySpans++
+			case s.live < s.nelems:
+				c.PartialSpans++
+				c.ExternalWaste += (s.nelems - s.live) * s.slotSize
+			default:
+				c.FullSpans++
+			}
+			perArena(span.startAddr, span.npages*_PageSize, func(a *ArenaOccupancy, n uintptr) { a.SpanBytes += n })
+			for _, obj := range s.objs {
+				perArena(obj, s.slotSize, func(a *ArenaOccupancy, n uintptr) { a.LiveBytes += n })
+			}
+			return nil
+		})
+	}
+	for i := range r.Classes {
+		if c := &r.Classes[i]; r.SizesTracked || i == 0 {
+			c.InternalWaste = c.LiveBytes - c.RequestedBytes
+		}
+	}
+
+	buckets := make(map[uintptr]*FreeChunkBucket)
+	m.h.lock.Lock()
+	m.h.freeChunks.treap.walkTreap(func(t *treapNode) {
+		pages := uintptr(1) << (bits.Len(uint(t.chunk.npages)) - 1)
+		bucket, ok := buckets[pages]
+		if !ok {
+			bucket = &FreeChunkBucket{Pages: pages}
+			buckets[pages] = bucket
+		}
+		bucket.Count++
+		bucket.Bytes += t.chunk.npages * _PageSize
+		perArena(t.chunk.startAddr, t.chunk.npages*_PageSize, func(a *ArenaOccupancy, n uintptr) { a.FreeBytes += n })
+	})
+	m.h.lock.Unlock()
+	for _, bucket := range buckets {
+		r.FreeChunks = append(r.FreeChunks, *bucket)
+	}
+	sort.Slice(r.FreeChunks, func(i, j int) bool { return r.FreeChunks[i].Pages < r.FreeChunks[j].Pages })
+	for _, a := range arenas {
+		r.Arenas = append(r.Arenas, *a)
+	}
+	sort.Slice(r.Arenas, func(i, j int) bool { return r.Arenas[i].Base < r.Arenas[j].Base })
+	return r
+}
+
+type spanFragmentation struct {
+	slotSize, nelems, live, requested uintptr
+	objs                              []uintptr // 存活对象地址
+}
+
+// fragmentation 统计span的存活对象，大对象span的slot是整个span
+func (s *xSpan) fragmentation(raw bool) spanFragmentation {
+	var f spanFragmentation
+	for _, obj := range s.liveObjects(nil, raw) {
+		f.objs = append(f.objs, obj.Addr)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f.live = uintptr(len(f.objs))
+	if s.classIndex == 0 {
+		f.slotSize, f.nelems = s.npages*_PageSize, 1
+		switch {
+		case s.guarded:
+			f.requested = f.live * s.classSize
+		case s.reqWaste != nil:
+			f.requested = f.live * (f.slotSize - s.waste(0))
+		default:
+			f.requested = f.live * f.slotSize
+		}
+		return f
+	}
+	f.slotSize, f.nelems = s.classSize, s.nelems
+	if s.reqWaste != nil {
+		for _, obj := range f.objs {
+			f.requested += s.classSize - s.waste(s.objIndex(obj))
+		}
+	}
+	return f
+}
+
+// newWasteTable Options.TrackSizes的请求大小表，每个slot一个uint16，记录 slot大小-请求大小
+func newWasteTable(nelems uintptr) (*uint16, error) {
+	if nelems < 1 {
+		nelems = 1
+	}
+	p, err := newXAllocator(nelems * unsafe.Sizeof(uint16(0))).alloc()
+	if err != nil {
+		return nil, err
+	}
+	return (*uint16)(p), nil
+}
+
+func (s *xSpan) setWaste(objIndex, waste uintptr) {
+	*(*uint16)(unsafe.Pointer(uintptr(unsafe.Pointer(s.reqWaste)) + objIndex*2)) = uint16(waste)
+}
+
+func (s *xSpan) waste(objIndex uintptr) uintptr {
+	return uintptr(*(*uint16)(unsafe.Pointer(uintptr(unsafe.Pointer(s.reqWaste)) + objIndex*2)))
+}
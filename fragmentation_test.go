@@ -0,0 +1,101 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"testing"
+)
+
+func TestFragmentationReport(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemoryWithOptions(0.75, Options{TrackSizes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 20字节的请求落在24字节的class
+	class := size_to_class8[(20+smallSizeDiv-1)/smallSizeDiv]
+	classSize := uintptr(class_to_size[class])
+	var addrs []uintptr
+	for i := 0; i < 1000; i++ {
+		p, err := m.Alloc(20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, uintptr(p))
+	}
+	for _, addr := range addrs[:100] {
+		if err := m.Free(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big, err := m.Alloc(_MaxSmallSize + 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := m.FragmentationReport()
+	if !r.SizesTracked {
+		t.Fatal(r)
+	}
+	c := r.Classes[class]
+	if c.Objects != 900 || c.LiveBytes != 900*classSize || c.RequestedBytes != 900*20 || c.InternalWaste != 900*(classSize-20) {
+		t.Fatalf("%+v", c)
+	}
+	if c.EmptySpans+c.PartialSpans+c.FullSpans == 0 || (c.PartialSpans > 0) != (c.ExternalWaste > 0) {
+		t.Fatalf("%+v", c)
+	}
+	large := r.Classes[0]
+	if large.Objects != 1 || large.RequestedBytes != _MaxSmallSize+100 || large.InternalWaste != Align(_MaxSmallSize+100, _PageSize)-_MaxSmallSize-100 {
+		t.Fatalf("%+v", large)
+	}
+	if len(r.FreeChunks) == 0 || len(r.Arenas) == 0 {
+		t.Fatal(r)
+	}
+	var free, live, spanBytes uintptr
+	for _, b := range r.FreeChunks {
+		free += b.Bytes
+	}
+	for _, a := range r.Arenas {
+		if a.SpanBytes+a.FreeBytes > a.Size || a.LiveBytes > a.SpanBytes {
+			t.Fatalf("%+v", a)
+		}
+		free -= a.FreeBytes
+		live += a.LiveBytes
+		spanBytes += a.SpanBytes
+	}
+	if free != 0 || live != 900*classSize+Align(_MaxSmallSize+100, _PageSize) || spanBytes == 0 {
+		t.Fatal(free, live, r)
+	}
+	if err := m.Free(uintptr(big)); err != nil {
+		t.Fatal(err)
+	}
+	t.Log(r)
+
+	// 未开启TrackSizes时不统计内部碎片
+	m2, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m2.Alloc(20); err != nil {
+		t.Fatal(err)
+	}
+	if r := m2.FragmentationReport(); r.SizesTracked || r.Classes[class].Objects != 1 || r.Classes[class].InternalWaste != 0 {
+		t.Fatalf("%+v", r.Classes[class])
+	}
+}
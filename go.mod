@@ -1,5 +1,5 @@
 module github.com/heiyeluren/xmm
 
-go 1.16
+go 1.18
 
 require github.com/spf13/cast v1.4.1
@@ -0,0 +1,105 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// 保护页(electric-fence)调试模式：
+// 对象独占若干页，并且右对齐到最后一个PROT_NONE的保护页，越界写立即触发SIGSEGV；
+// 释放后整个span都设置为PROT_NONE并且不再复用，use-after-free同样立即触发SIGSEGV。
+
+// guardAlign 右对齐时保证的对象对齐，小于guardAlign的越界无法发现
+const guardAlign = 8
+
+func (sp *xSpanPool) needGuard(size uintptr) bool {
+	opts := &sp.heap.opts
+	return opts.GuardPages && (size > _MaxSmallSize || opts.GuardAll)
+}
+
+// allocGuarded 分配 对象页 + 1个保护页，返回右对齐的对象地址
+func (sp *xSpanPool) allocGuarded(size uintptr) (unsafe.Pointer, error) {
+	pageNum := Align(size, _PageSize) / _PageSize
+	span, err := sp.heap.allocGuardedSpan(pageNum, size)
+	if err != nil {
+		return nil, err
+	}
+	ptr := span.guardedAddr()
+	if err := sp.clear(ptr, size); err != nil {
+		return nil, err
+	}
+	sp.classSpan[0].releaseSpan(span)
+	return unsafe.Pointer(ptr), nil
+}
+
+// allocGuardedSpan 分配pageNum+1页的span，最后一页设置为保护页，classSize记录对齐后的对象大小
+func (xh *xHeap) allocGuardedSpan(pageNum, size uintptr) (*xSpan, error) {
+	span, err := xh.allocRawSpan(pageNum + 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := span.Init(0, xh); err != nil {
+		return nil, err
+	}
+	span.allocCount = 1
+	span.nelems = 1
+	span.guarded = true
+	span.classSize = Align(size, guardAlign)
+	if err := sysProtect(span.startAddr+pageNum*_PageSize, _PageSize, syscall.PROT_NONE); err != nil {
+		return nil, err
+	}
+	return span, nil
+}
+
+// guardedAddr 保护页span中右对齐的对象地址
+func (s *xSpan) guardedAddr() uintptr {
+	return s.startAddr + (s.npages-1)*_PageSize - s.classSize
+}
+
+// freeGuarded 释放保护页模式分配的对象：整个span设置为PROT_NONE，页不再还给堆。addr必须是对象的起始地址
+func (xh *xHeap) freeGuarded(span *xSpan, addr uintptr) error {
+	if addr != span.guardedAddr() {
+		return InteriorPointerError
+	}
+	span.lock.Lock()
+	defer span.lock.Unlock()
+	if span.markBitsForBase().isMarked() {
+		return fmt.Errorf("xmm: double free of guarded addr(%d)", addr)
+	}
+	if err := sysProtect(span.startAddr, span.npages*_PageSize, syscall.PROT_NONE); err != nil {
+		return err
+	}
+	span.markBitsForBase().setMarked()
+	return nil
+}
+
+// guardedSpanOf 返回addr所在的保护页span，不是保护页span时返回nil
+func (xh *xHeap) guardedSpanOf(addr uintptr) *xSpan {
+	if !xh.opts.GuardPages {
+		return nil
+	}
+	span, err := xh.spanOf(addr)
+	if err != nil || span == nil || !span.guarded {
+		return nil
+	}
+	return span
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"runtime/debug"
+	"testing"
+	"unsafe"
+)
+
+// faults 执行fn，返回是否触发了内存访问错误
+func faults(fn func()) (fault bool) {
+	old := debug.SetPanicOnFault(true)
+	defer debug.SetPanicOnFault(old)
+	defer func() {
+		if recover() != nil {
+			fault = true
+		}
+	}()
+	fn()
+	return false
+}
+
+func TestGuardPages(t *testing.T) {
+	f := &Factory{}
+	mm, err := f.CreateMemoryWithOptions(0.75, Options{GuardPages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := uintptr(_MaxSmallSize + 100)
+	p, err := mm.Alloc(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := (*[1 << 30]byte)(p)[: size+guardAlign : size+guardAlign]
+	if faults(func() { buf[size-1] = 1 }) {
+		t.Fatal("in bounds write faulted")
+	}
+	if !faults(func() { buf[size+guardAlign-1] = 1 }) {
+		t.Fatal("overflow not detected")
+	}
+	// 小对象不受保护
+	small, err := mm.Alloc(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.Free(uintptr(small)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 内部指针不能释放对象
+	if err := mm.Free(uintptr(p) + 8); err != InteriorPointerError {
+		t.Fatal(err)
+	}
+	if faults(func() { buf[0] = 1 }) {
+		t.Fatal("interior free protected the object")
+	}
+	if err := mm.Free(uintptr(p)); err != nil {
+		t.Fatal(err)
+	}
+	if !faults(func() { buf[0] = 1 }) {
+		t.Fatal("use after free not detected")
+	}
+	if err := mm.Free(uintptr(p)); err == nil {
+		t.Fatal("double free not detected")
+	}
+
+	chunk, err := mm.RawAlloc(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := (*[1 << 30]byte)(unsafe.Pointer(chunk.StartAddr))
+	if faults(func() { raw[2*_PageSize-1] = 1 }) {
+		t.Fatal("in bounds write faulted")
+	}
+	if !faults(func() { raw[2*_PageSize] = 1 }) {
+		t.Fatal("raw overflow not detected")
+	}
+}
+
+func TestGuardAll(t *testing.T) {
+	f := &Factory{}
+	if _, err := f.CreateMemoryWithOptions(0.75, Options{GuardAll: true}); err == nil {
+		t.Fatal("GuardAll without GuardPages")
+	}
+	mm, err := f.CreateMemoryWithOptions(0.75, Options{GuardPages: true, GuardAll: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := mm.Alloc(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uintptr(p)%guardAlign != 0 {
+		t.Fatal("misaligned", p)
+	}
+	s, err := mm.From("hello")
+	if err != nil || s != "hello" {
+		t.Fatal(s, err)
+	}
+	buf := (*[1 << 30]byte)(p)
+	if !faults(func() { buf[16] = 1 }) {
+		t.Fatal("overflow not detected")
+	}
+	if err := mm.FreeString(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.Free(uintptr(p)); err != nil {
+		t.Fatal(err)
+	}
+	if !faults(func() { buf[0] = 1 }) {
+		t.Fatal("use after free not detected")
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+var InvalidHandleError = errors.New("handle is invalid or freed")
+
+var HandlePinnedError = errors.New("handle is pinned")
+
+// DefaultCompactSparseFactor Options.CompactSparseFactor的默认值
+const DefaultCompactSparseFactor = 0.5
+
+// Handle 通过句柄表间接引用的对象，Compact可以移动对象，使用前需要Pin得到临时地址。
+// 低32位为句柄表下标+1(0为非法句柄)，高32位为generation，释放后的句柄不会再指向新对象
+type Handle uint64
+
+func makeHandle(index, gen uint32) Handle {
+	return Handle(uint64(gen)<<32 | uint64(index+1))
+}
+
+type handleEntry struct {
+	addr uintptr // 0为空闲
+	size uintptr
+	gen  uint32
+	pins int32
+}
+
+// handleTable 句柄表，Pin/Unpin持有读锁，分配、释放和Compact移动对象持有写锁
+type handleTable struct {
+	lock    sync.RWMutex
+	entries []handleEntry
+	free    []uint32
+}
+
+// entry 需要持有锁
+func (t *handleTable) entry(h Handle) (*handleEntry, error) {
+	index, gen := uint32(h), uint32(h>>32)
+	if index == 0 || int(index) > len(t.entries) {
+		return nil, InvalidHandleError
+	}
+	e := &t.entries[index-1]
+	if e.addr == 0 || e.gen != gen {
+		return nil, InvalidHandleError
+	}
+	return e, nil
+}
+
+// AllocHandle 分配size字节的可移动对象
+func (m *mm) AllocHandle(size uintptr) (Handle, error) {
+	if size < 1 {
+		return 0, NilError
+	}
+	p, err := m.sp.Alloc(size)
+	if err != nil {
+		return 0, err
+	}
+	m.onAlloc(uintptr(p), size)
+	t := &m.handles
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var index uint32
+	if n := len(t.free); n > 0 {
+		index, t.free = t.free[n-1], t.free[:n-1]
+	} else {
+		index = uint32(len(t.entries))
+		t.entries = append(t.entries, handleEntry{})
+	}
+	e := &t.entries[index]
+	if e.gen++; e.gen == 0 {
+		e.gen = 1
+	}
+	e.addr, e.size, e.pins = uintptr(p), size, 0
+	return makeHandle(index, e.gen), nil
+}
+
+// Pin 返回对象的当前地址，Unpin之前对象不会被Compact移动。可以重复Pin，需要同样次数的Unpin
+func (m *mm) Pin(h Handle) (unsafe.Pointer, error) {
+	t := &m.handles
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	e, err := t.entry(h)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&e.pins, 1)
+	return *(*unsafe.Pointer)(unsafe.Pointer(&e.addr)), nil
+}
+
+// Unpin Unpin之后Pin返回的地址不再有效
+func (m *mm) Unpin(h Handle) error {
+	t := &m.handles
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	e, err := t.entry(h)
+	if err != nil {
+		return err
+	}
+	if atomic.AddInt32(&e.pins, -1) < 0 {
+		atomic.AddInt32(&e.pins, 1)
+		return errors.New("handle is not pinned")
+	}
+	return nil
+}
+
+// FreeHandle 释放对象，被Pin的对象返回HandlePinnedError
+func (m *mm) FreeHandle(h Handle) error {
+	t := &m.handles
+	t.lock.Lock()
+	e, err := t.entry(h)
+	if err != nil {
+		t.lock.Unlock()
+		return err
+	}
+	if atomic.LoadInt32(&e.pins) > 0 {
+		t.lock.Unlock()
+		return HandlePinnedError
+	}
+	addr := e.addr
+	e.addr = 0
+	t.free = append(t.free, uint32(h)-1)
+	t.lock.Unlock()
+	if err := m.sp.Free(addr); err != nil {
+		return err
+	}
+	m.onFree(addr)
+	return nil
+}
+
+// CompactStats Compact的结果
+type CompactStats struct {
+	Moved         int     // 移动的对象数
+	Pinned        int     // 被Pin而没有移动的对象数
+	SpansReleased int     // 还给页堆的span数
+	PagesReleased uintptr // 还给页堆的页数
+}
+
+// Compact 把稀疏span(存活比例不超过Options.CompactSparseFactor且都是句柄对象)中没有被Pin的对象搬到其他span，
+// 然后把清空的span还给页堆。可以和Pin/Unpin并发，多个Compact之间互斥
+func (m *mm) Compact() (*CompactStats, error) {
+	sp, ok := m.sp.(*xSpanPool)
+	if !ok {
+		return nil, errors.New("spanPool is not support compact")
+	}
+	if m.h.debug != nil || m.h.opts.GuardPages {
+		return nil, errors.New("compact is not supported in Poison or GuardPages mode")
+	}
+	m.compactLock.Lock()
+	defer m.compactLock.Unlock()
+
+	// 句柄对象地址 -> 句柄表下标
+	t := &m.handles
+	t.lock.RLock()
+	owners := make(map[uintptr]uint32, len(t.entries))
+	for i := range t.entries {
+		if addr := t.entries[i].addr; addr != 0 {
+			owners[addr] = uint32(i)
+		}
+	}
+	t.lock.RUnlock()
+
+	// 只处理free、full链表中的span，正在分配的span不动
+	var spans []*xSpan
+	_ = sp.foreachSpan(func(span *xSpan, kind spanKind) error {
+		if span.classIndex > 0 && !span.guarded && (kind == spanFull || kind == spanFree) {
+			spans = append(spans, span)
+		}
+		return nil
+	})
+	factor := m.h.opts.CompactSparseFactor
+	if factor == 0 {
+		factor = DefaultCompactSparseFactor
+	}
+	stats := &CompactStats{}
+	var objs []ObjectInfo
+	for _, span := range spans {
+		objs = span.liveObjects(objs[:0], false)
+		if uintptr(len(objs)) > uintptr(float64(span.nelems)*factor) {
+			continue
+		}
+		sparse := true
+		for _, obj := range objs {
+			if _, ok := owners[obj.Addr]; !ok {
+				sparse = false
+				break
+			}
+		}
+		if !sparse {
+			continue
+		}
+		for _, obj := range objs {
+			moved, err := m.moveHandle(owners[obj.Addr], obj.Addr)
+			if err != nil {
+				return stats, err
+			}
+			if moved {
+				stats.Moved++
+			} else {
+				stats.Pinned++
+			}
+		}
+		released, err := sp.releaseEmptySpan(span)
+		if err != nil {
+			return stats, err
+		}
+		if released {
+			stats.SpansReleased++
+			stats.PagesReleased += span.npages
+		}
+	}
+	return stats, nil
+}
+
+// moveHandle 把句柄对象从old搬到新分配的地址，被Pin时不移动。对象已经被FreeHandle时当作已移动
+func (m *mm) moveHandle(index uint32, old uintptr) (bool, error) {
+	t := &m.handles
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	e := &t.entries[index]
+	if e.addr != old {
+		return true, nil
+	}
+	if atomic.LoadInt32(&e.pins) > 0 {
+		return false, nil
+	}
+	p, err := m.sp.Alloc(e.size)
+	if err != nil {
+		return false, err
+	}
+	copy(rawBytes(uintptr(p), e.size), rawBytes(old, e.size))
+	e.addr = uintptr(p)
+	if err := m.sp.Free(old); err != nil {
+		return true, err
+	}
+	if m.leaks != nil {
+		m.leaks.move(old, e.addr)
+	}
+	if m.prof != nil {
+		m.prof.move(old, e.addr)
+	}
+	return true, nil
+}
+
+// releaseEmptySpan span中所有已分配的对象都被Free时，把span从free/full链表中摘下并还给页堆。
+// 持有class锁，growSpan不会同时把free链表中的span取出；sweep在span锁内移动链表
+func (sp *xSpanPool) releaseEmptySpan(span *xSpan) (bool, error) {
+	sp.lock[span.classIndex].Lock()
+	defer sp.lock[span.classIndex].Unlock()
+	span.lock.Lock()
+	defer span.lock.Unlock()
+	gcCount := span.countGcMarkBits()
+	if span.allocCount != gcCount {
+		return false, nil
+	}
+	xh := sp.heap
+	classSpan := xh.classSpan[span.classIndex]
+	if !classSpan.full.remove(span) && !classSpan.free.remove(span) {
+		return false, nil
+	}
+	// 之后sweep看到allocCount < nelems不会再回收
+	span.allocCount = 0
+	xh.addFreeCapacity(-int64(gcCount * span.classSize))
+	return true, xh.releasePages(span)
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type handleItem struct {
+	id  uint64
+	sum uint64
+	pad [4]uint64
+}
+
+func allocHandleItems(t *testing.T, m XMemory, n int) []Handle {
+	handles := make([]Handle, n)
+	for i := range handles {
+		h, err := m.AllocHandle(48)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := m.Pin(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		item := (*handleItem)(p)
+		item.id, item.sum = uint64(i), uint64(i)*3
+		if err := m.Unpin(h); err != nil {
+			t.Fatal(err)
+		}
+		handles[i] = h
+	}
+	return handles
+}
+
+func checkHandleItem(t *testing.T, m XMemory, h Handle, i int) {
+	p, err := m.Pin(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unpin(h)
+	if item := (*handleItem)(p); item.id != uint64(i) || item.sum != uint64(i)*3 {
+		t.Fatalf("handle %d: %+v", i, *item)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handles := allocHandleItems(t, m, 10)
+	if err := m.FreeHandle(handles[3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Pin(handles[3]); err != InvalidHandleError {
+		t.Fatal(err)
+	}
+	if err := m.FreeHandle(handles[3]); err != InvalidHandleError {
+		t.Fatal(err)
+	}
+	// 下标被复用，旧句柄仍然无效
+	h, err := m.AllocHandle(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint32(h) != uint32(handles[3]) || h == handles[3] {
+		t.Fatal(h, handles[3])
+	}
+	if _, err := m.Pin(handles[3]); err != InvalidHandleError {
+		t.Fatal(err)
+	}
+	if _, err := m.Pin(0); err != InvalidHandleError {
+		t.Fatal(err)
+	}
+	if _, err := m.Pin(handles[5]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.FreeHandle(handles[5]); err != HandlePinnedError {
+		t.Fatal(err)
+	}
+	if err := m.Unpin(handles[5]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unpin(handles[5]); err == nil {
+		t.Fatal("unpin twice")
+	}
+	if err := m.FreeHandle(handles[5]); err != nil {
+		t.Fatal(err)
+	}
+	checkHandleItem(t, m, handles[9], 9)
+}
+
+func TestCompact(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handles := allocHandleItems(t, m, 20000)
+	// 每个span只留下少量对象
+	live := make(map[int]Handle)
+	for i, h := range handles {
+		if i%10 != 0 {
+			if err := m.FreeHandle(h); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			live[i] = h
+		}
+	}
+	// 全部Pin时不移动
+	for _, h := range live {
+		if _, err := m.Pin(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := m.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 0 || stats.Pinned == 0 {
+		t.Fatalf("%+v", stats)
+	}
+	for _, h := range live {
+		if err := m.Unpin(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := m.FragmentationReport()
+	if stats, err = m.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%+v", stats)
+	if stats.Moved == 0 || stats.SpansReleased == 0 || stats.Pinned != 0 {
+		t.Fatalf("%+v", stats)
+	}
+	for i, h := range live {
+		checkHandleItem(t, m, h, i)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	after := m.FragmentationReport()
+	class := m.(*mm).h.classes.sizeToClass(48)
+	if b, a := before.Classes[class], after.Classes[class]; a.ExternalWaste >= b.ExternalWaste {
+		t.Fatalf("before %+v after %+v", b, a)
+	}
+	// 释放的页可以重新分配
+	for i := 0; i < 20000; i++ {
+		if _, err := m.Alloc(48); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range live {
+		checkHandleItem(t, m, h, i)
+	}
+}
+
+func TestCompactSparseFactor(t *testing.T) {
+	f := &Factory{}
+	if _, err := f.CreateMemoryWithOptions(0.75, Options{CompactSparseFactor: 1.5}); err == nil {
+		t.Fatal("CompactSparseFactor > 1")
+	}
+	// 存活10%的span在阈值5%时不算稀疏
+	m, err := f.CreateMemoryWithOptions(0.75, Options{CompactSparseFactor: 0.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handles := allocHandleItems(t, m, 20000)
+	for i, h := range handles {
+		if i%10 != 0 {
+			if err := m.FreeHandle(h); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	stats, err := m.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 0 {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+func TestCompactConcurrentPin(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handles := allocHandleItems(t, m, 20000)
+	var live []int
+	for i, h := range handles {
+		if i%8 != 0 {
+			if err := m.FreeHandle(h); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			live = append(live, i)
+		}
+	}
+	var stop int32
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := g; atomic.LoadInt32(&stop) == 0; n++ {
+				i := live[n%len(live)]
+				p, err := m.Pin(handles[i])
+				if err != nil {
+					errs <- err
+					return
+				}
+				item := (*handleItem)(p)
+				ok := item.id == uint64(i) && item.sum == uint64(i)*3
+				if err := m.Unpin(handles[i]); err != nil || !ok {
+					errs <- InvalidHandleError
+					return
+				}
+			}
+		}(g)
+	}
+	var moved int
+	for round := 0; round < 3; round++ {
+		stats, err := m.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		moved += stats.Moved
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if moved == 0 {
+		t.Fatal("nothing moved")
+	}
+	for _, i := range live {
+		checkHandleItem(t, m, handles[i], i)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
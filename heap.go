@@ -49,7 +49,11 @@ type xHeap struct {
 
 	rawLinearMemoryAllocator *xAllocator
 
-	classSpan [_NumSizeClasses]*xClassSpan
+	classes *sizeClasses // size class表，见Options.SizeClasses
+
+	classSpan []*xClassSpan
+
+	rawSpans mSpanList // RawAlloc分配的span
 
 	totalCapacity int64
 
@@ -60,11 +64,45 @@ type xHeap struct {
 	sweepCtl int32 // -10000<= sweepCtl < 0 正在扩容  0:非扩容状态
 
 	sweepLastTime time.Time
+
+	base uintptr // 堆基址(第一块RawMemory的起始地址)，RelPtr相对于它编码
+
+	opts Options
+
+	debug *heapDebug // Poison模式，见poison.go
 }
 
 const sweepCtlStatus = -68
 
 func newXHeap() (*xHeap, error) {
+	return newXHeapWithOptions(Options{})
+}
+
+func newXHeapWithOptions(opts Options) (*xHeap, error) {
+	heap, err := newEmptyXHeap(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := heap.rawLinearMemoryAlloc.expand(nil, heapRawMemoryBytes); err != nil {
+		return nil, err
+	}
+	heap.base = heap.rawLinearMemoryAlloc.next
+	return heap, nil
+}
+
+// newEmptyXHeap 初始化元数据，不预留堆内存(快照恢复时在指定地址预留)
+func newEmptyXHeap(opts Options) (*xHeap, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	classes, err := newSizeClasses(opts.SizeClasses)
+	if err != nil {
+		return nil, err
+	}
+	// 元数据选项要在分配元数据之前设置
+	if err := addMetadataAdvice(opts.advice()); err != nil {
+		return nil, err
+	}
 	call := func(inuse uintptr) { log.Printf("XSliceAllocator xChunk 扩容了，使用了 inuse:%d\n", inuse) }
 	chunkAllocator := newXAllocator(unsafe.Sizeof(xChunk{}))
 	valAllocator := newXAllocator(unsafe.Sizeof(treapNode{}))
@@ -76,9 +114,10 @@ func newXHeap() (*xHeap, error) {
 	}
 	freeChunks := newXTreap(valAllocator)
 	heap := &xHeap{allChunkAllocator: allChunkAllocator, chunkAllocator: chunkAllocator, freeChunks: freeChunks,
-		spanAllocator: spanAllocator, rawLinearMemoryAllocator: rawLinearMemoryAllocator}
-	if err := heap.rawLinearMemoryAlloc.expand(nil, heapRawMemoryBytes); err != nil {
-		return nil, err
+		spanAllocator: spanAllocator, rawLinearMemoryAllocator: rawLinearMemoryAllocator, opts: opts, classes: classes}
+	heap.rawLinearMemoryAlloc.advice = opts.advice()
+	if opts.Poison {
+		heap.debug = newHeapDebug(&opts)
 	}
 	if err := heap.initClassSpan(); err != nil {
 		return nil, err
@@ -87,7 +126,8 @@ func newXHeap() (*xHeap, error) {
 }
 
 func (xh *xHeap) initClassSpan() error {
-	for i := 0; i < _NumSizeClasses; i++ {
+	xh.classSpan = make([]*xClassSpan, xh.classes.num())
+	for i := range xh.classSpan {
 		classSpan := &xClassSpan{}
 		xh.classSpan[i] = classSpan
 		if err := classSpan.Init(uint(i), xh); err != nil {
@@ -273,6 +313,22 @@ func (xh *xHeap) free(addr uintptr) error {
 	return nil
 }
 
+// objectBase addr所在对象的起始地址
+func (xh *xHeap) objectBase(addr uintptr) (uintptr, error) {
+	span, err := xh.spanOf(addr)
+	if err != nil {
+		return 0, err
+	}
+	if span == nil {
+		return 0, fmt.Errorf("addr(%d) is not in any span", addr)
+	}
+	if span.guarded {
+		return span.guardedAddr(), nil
+	}
+	base, _ := slotOf(span, addr)
+	return base, nil
+}
+
 func (xh *xHeap) needSweep() bool {
 	val, sweepThreshold := atomic.LoadInt64(&xh.freeCapacity), float64(xh.totalCapacity)*TotalGCFactor
 	if sweepThreshold > float64(val) {
@@ -307,13 +363,15 @@ func (xh *xHeap) sweep() {
 	}
 	var sweepIndex uint32
 	var total uint
-	for sweepIndex = atomic.LoadUint32(&xh.sweepIndex); sweepIndex < _NumSizeClasses; sweepIndex = atomic.LoadUint32(&xh.sweepIndex) {
+	for sweepIndex = atomic.LoadUint32(&xh.sweepIndex); sweepIndex < uint32(len(xh.classSpan)); sweepIndex = atomic.LoadUint32(&xh.sweepIndex) {
 		if !atomic.CompareAndSwapUint32(&xh.sweepIndex, sweepIndex, sweepIndex+1) {
 			continue
 		}
 		classSpan := xh.classSpan[sweepIndex]
 		// todo 环循环
-		for span := classSpan.full.first; span != nil; span = span.next {
+		// 回收的span会从full中移除并改写span.next，需要先保存next
+		for span, next := classSpan.full.first, (*xSpan)(nil); span != nil; span = next {
+			next = span.next
 			if logg {
 				fmt.Println("sweep", sweepIndex, uintptr(unsafe.Pointer(span)))
 			}
@@ -322,7 +380,6 @@ func (xh *xHeap) sweep() {
 				continue
 			} else if sweep {
 				total += size
-				classSpan.full.move(span)
 			}
 		}
 	}
@@ -358,6 +415,13 @@ func (xh *xHeap) ChunkInsert(chunk *xChunk) error {
 // 清理span（span级别锁）
 func (xh *xHeap) sweepFullSpan(span *xSpan) (sweep bool, size uint, err error) {
 	// fmt.Println("======================")
+	if span.guarded {
+		// 保护页模式释放后的页永远不复用
+		return false, 0, nil
+	}
+	if xh.debug != nil {
+		xh.debug.checkSpan(span)
+	}
 	if span.classIndex > 0 {
 		// 所有还给classspan
 		return xh.classSpan[span.classIndex].freeSpan(span)
@@ -379,6 +443,9 @@ func (xh *xHeap) sweepFullSpan(span *xSpan) (sweep bool, size uint, err error) {
 		}
 		chunk.startAddr = span.startAddr
 		chunk.npages = span.npages
+		xh.classSpan[0].full.move(span)
+		// 还给treap的页不再属于span
+		xh.setSpans(span.startAddr, span.npages, nil)
 		if err := xh.ChunkInsert(chunk); err != nil {
 			return false, 0, err
 		}
@@ -386,6 +453,19 @@ func (xh *xHeap) sweepFullSpan(span *xSpan) (sweep bool, size uint, err error) {
 	return true, uint(span.npages * _PageSize), nil
 }
 
+// releasePages 把span的页还给页堆，之后span不能再使用
+func (xh *xHeap) releasePages(span *xSpan) error {
+	chunkP, err := xh.chunkAllocator.alloc()
+	if err != nil {
+		return err
+	}
+	chunk := (*xChunk)(chunkP)
+	chunk.startAddr = span.startAddr
+	chunk.npages = span.npages
+	xh.setSpans(span.startAddr, span.npages, nil)
+	return xh.ChunkInsert(chunk)
+}
+
 func (xh *xHeap) mark(addr uintptr) error {
 	err := markBitsForAddr(addr, xh)
 	if err != nil {
@@ -406,7 +486,7 @@ func (xh *xHeap) grow2(pageNum uintptr) error {
 	}
 	if err == LackOfMemoryErr {
 		if err := xh.rawLinearMemoryAlloc.expand(nil, heapRawMemoryBytes); err != nil {
-			var la linearAlloc
+			la := linearAlloc{advice: xh.rawLinearMemoryAlloc.advice}
 			la.expand(nil, heapRawMemoryBytes)
 			xh.rawLinearMemoryAlloc = la
 		}
@@ -453,7 +533,7 @@ func (xh *xHeap) grow() error {
 	}
 	if err == LackOfMemoryErr {
 		if err := xh.rawLinearMemoryAlloc.expand(nil, heapRawMemoryBytes); err != nil {
-			var la linearAlloc
+			la := linearAlloc{advice: xh.rawLinearMemoryAlloc.advice}
 			la.expand(nil, heapRawMemoryBytes)
 			xh.rawLinearMemoryAlloc = la
 		}
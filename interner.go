@@ -0,0 +1,251 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+
+	internMinCap = 64
+)
+
+var NotInternedError = errors.New("string is not interned")
+
+var InternerFreedError = errors.New("interner has been freed")
+
+// internEntry 哈希表的一项，hash为0表示空
+type internEntry struct {
+	hash uint64
+	data uintptr
+	len  uintptr
+	refs int64
+}
+
+// Interner 字符串驻留表：相同内容只在XMM内存中保存一份。哈希表(线性探测)本身也在XMM内存中，不增加GC扫描。
+// refCount为true时Intern计数，Release到0时删除并FreeString
+type Interner struct {
+	m        XMemory
+	refCount bool
+
+	lock    sync.Mutex
+	entries uintptr // [cap]internEntry
+	cap     uintptr // 2的幂
+	count   uintptr
+	bytes   uintptr
+}
+
+// NewInterner 创建字符串驻留表
+func NewInterner(m XMemory, refCount bool) (*Interner, error) {
+	if m == nil {
+		return nil, NilError
+	}
+	in := &Interner{m: m, refCount: refCount}
+	if err := in.resize(internMinCap); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+func internHash(s string) uint64 {
+	h := uint64(fnvOffset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	if h == 0 {
+		h = 1
+	}
+	return h
+}
+
+func (in *Interner) entry(i uintptr) *internEntry {
+	return (*internEntry)(unsafe.Pointer(in.entries + i*unsafe.Sizeof(internEntry{})))
+}
+
+func (e *internEntry) string() (s string) {
+	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
+	sh.Data, sh.Len = e.data, int(e.len)
+	return s
+}
+
+// find 返回s所在的位置，不存在时返回应该插入的空位置
+func (in *Interner) find(s string, hash uint64) (*internEntry, bool) {
+	mask := in.cap - 1
+	for i := uintptr(hash) & mask; ; i = (i + 1) & mask {
+		e := in.entry(i)
+		if e.hash == 0 {
+			return e, false
+		}
+		if e.hash == hash && e.string() == s {
+			return e, true
+		}
+	}
+}
+
+// Intern 返回s在XMM内存中的唯一副本
+func (in *Interner) Intern(s string) (string, error) {
+	if len(s) == 0 {
+		return "", nil
+	}
+	hash := internHash(s)
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if in.entries == 0 {
+		return "", InternerFreedError
+	}
+	e, ok := in.find(s, hash)
+	if ok {
+		e.refs++
+		return e.string(), nil
+	}
+	// 负载因子不超过3/4
+	if (in.count+1)*4 > in.cap*3 {
+		if err := in.resize(in.cap * 2); err != nil {
+			return "", err
+		}
+		e, _ = in.find(s, hash)
+	}
+	p, err := in.m.From(s)
+	if err != nil {
+		return "", err
+	}
+	e.hash, e.data, e.len, e.refs = hash, (*reflect.StringHeader)(unsafe.Pointer(&p)).Data, uintptr(len(s)), 1
+	in.count++
+	in.bytes += uintptr(len(s))
+	return p, nil
+}
+
+// Release 引用计数减一，到0时删除并释放字符串。没有开启引用计数时返回错误
+func (in *Interner) Release(s string) error {
+	if !in.refCount {
+		return errors.New("reference counting is disabled")
+	}
+	if len(s) == 0 {
+		return nil
+	}
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if in.entries == 0 {
+		return InternerFreedError
+	}
+	e, ok := in.find(s, internHash(s))
+	if !ok {
+		return NotInternedError
+	}
+	if e.refs--; e.refs > 0 {
+		return nil
+	}
+	p := e.string()
+	in.remove(e)
+	in.count--
+	in.bytes -= uintptr(len(p))
+	return in.m.FreeString(p)
+}
+
+// remove 删除e并把后面的项前移(线性探测不用墓碑)
+func (in *Interner) remove(e *internEntry) {
+	mask := in.cap - 1
+	size := unsafe.Sizeof(internEntry{})
+	hole := (uintptr(unsafe.Pointer(e)) - in.entries) / size
+	for i := (hole + 1) & mask; ; i = (i + 1) & mask {
+		next := in.entry(i)
+		if next.hash == 0 {
+			break
+		}
+		// next的理想位置不在(hole, i]之间时可以移到hole
+		home := uintptr(next.hash) & mask
+		if (i-home)&mask >= (i-hole)&mask {
+			*in.entry(hole) = *next
+			hole = i
+		}
+	}
+	*in.entry(hole) = internEntry{}
+}
+
+// resize 分配新的哈希表并重新插入
+func (in *Interner) resize(cap uintptr) error {
+	size := cap * unsafe.Sizeof(internEntry{})
+	p, err := in.m.Alloc(size)
+	if err != nil {
+		return err
+	}
+	// 大对象不会清零
+	clearBytes(uintptr(p), size)
+	old, oldCap := in.entries, in.cap
+	in.entries, in.cap = uintptr(p), cap
+	for i := uintptr(0); i < oldCap; i++ {
+		e := (*internEntry)(unsafe.Pointer(old + i*unsafe.Sizeof(internEntry{})))
+		if e.hash == 0 {
+			continue
+		}
+		mask := cap - 1
+		j := uintptr(e.hash) & mask
+		for in.entry(j).hash != 0 {
+			j = (j + 1) & mask
+		}
+		*in.entry(j) = *e
+	}
+	if old != 0 {
+		return in.m.Free(old)
+	}
+	return nil
+}
+
+// Free 释放所有驻留的字符串和哈希表，之前Intern返回的字符串都不能再使用，之后调用Intern/Release返回InternerFreedError
+func (in *Interner) Free() error {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if in.entries == 0 {
+		return InternerFreedError
+	}
+	var err error
+	for i := uintptr(0); i < in.cap; i++ {
+		if e := in.entry(i); e.hash != 0 {
+			if fe := in.m.FreeString(e.string()); fe != nil && err == nil {
+				err = fe
+			}
+		}
+	}
+	if fe := in.m.Free(in.entries); fe != nil && err == nil {
+		err = fe
+	}
+	in.entries, in.cap, in.count, in.bytes = 0, 0, 0, 0
+	return err
+}
+
+// Len 驻留的字符串个数
+func (in *Interner) Len() int {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return int(in.count)
+}
+
+// Bytes 驻留的字符串总字节数
+func (in *Interner) Bytes() uintptr {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.bytes
+}
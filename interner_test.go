@@ -0,0 +1,164 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func TestInterner(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := NewInterner(m, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canon := make(map[string]uintptr)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 5000; i++ {
+			s := fmt.Sprintf("key-%d", i)
+			p, err := in.Intern(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != s {
+				t.Fatal(p, s)
+			}
+			if addr, ok := canon[s]; ok && addr != stringData(p) {
+				t.Fatal("not canonical", s)
+			} else if !ok {
+				canon[s] = stringData(p)
+			}
+			if _, err := m.(*mm).h.spanOf(stringData(p)); err != nil {
+				t.Fatal("not in xmm", err)
+			}
+		}
+	}
+	if in.Len() != 5000 || in.cap < 5000 {
+		t.Fatal(in.Len(), in.cap)
+	}
+	if p, err := in.Intern(""); err != nil || p != "" {
+		t.Fatal(p, err)
+	}
+	if err := in.Release("key-1"); err == nil {
+		t.Fatal("refCount is off")
+	}
+}
+
+func TestInternerRelease(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := NewInterner(m, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 2000
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i%3; j++ {
+			if _, err := in.Intern(fmt.Sprintf("s%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// 引用一次的删除，删除后其他字符串仍然能找到(线性探测前移)
+	for i := 0; i < n; i += 3 {
+		if err := in.Release(fmt.Sprintf("s%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if in.Len() != n-(n+2)/3 {
+		t.Fatal(in.Len())
+	}
+	for i := 0; i < n; i++ {
+		s := fmt.Sprintf("s%d", i)
+		e, ok := in.find(s, internHash(s))
+		if ok != (i%3 != 0) {
+			t.Fatal(i, ok)
+		}
+		if ok && e.refs != int64(i%3+1) {
+			t.Fatal(i, e.refs)
+		}
+	}
+	if err := in.Release("s0"); err != NotInternedError {
+		t.Fatal(err)
+	}
+	for i := 1; i < n; i++ {
+		if i%3 == 0 {
+			continue
+		}
+		for j := 0; j <= i%3; j++ {
+			if err := in.Release(fmt.Sprintf("s%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if in.Len() != 0 || in.Bytes() != 0 {
+		t.Fatal(in.Len(), in.Bytes())
+	}
+	for i := uintptr(0); i < in.cap; i++ {
+		if in.entry(i).hash != 0 {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestInternerFree(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemoryWithOptions(0.75, Options{TrackLeaks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := NewInterner(m, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := in.Intern(fmt.Sprintf("s%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := in.Free(); err != nil {
+		t.Fatal(err)
+	}
+	if leaks := m.LeakReport(); len(leaks) != 0 {
+		t.Fatal(leaks)
+	}
+	if in.Len() != 0 || in.Bytes() != 0 {
+		t.Fatal(in.Len(), in.Bytes())
+	}
+	if _, err := in.Intern("s0"); err != InternerFreedError {
+		t.Fatal(err)
+	}
+	if err := in.Free(); err != InternerFreedError {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxStackDepth 记录的调用栈深度
+const maxStackDepth = 32
+
+type callStack [maxStackDepth]uintptr
+
+// pcs 去掉末尾的0
+func (s *callStack) pcs() []uintptr {
+	n := 0
+	for n < len(s) && s[n] != 0 {
+		n++
+	}
+	return s[:n]
+}
+
+// stackTable 调用栈去重，相同的调用栈只保存一份，不加锁
+type stackTable struct {
+	ids    map[callStack]int32
+	stacks []callStack
+}
+
+func (st *stackTable) intern(stack *callStack) int32 {
+	if st.ids == nil {
+		st.ids = make(map[callStack]int32)
+	}
+	id, ok := st.ids[*stack]
+	if !ok {
+		id = int32(len(st.stacks))
+		st.stacks = append(st.stacks, *stack)
+		st.ids[*stack] = id
+	}
+	return id
+}
+
+func (st *stackTable) pcs(id int32) []uintptr {
+	return st.stacks[id].pcs()
+}
+
+type leakRecord struct {
+	size  uintptr
+	stack int32 // stackTable下标
+}
+
+// leakTracker Options.TrackLeaks开启后记录每个存活对象的分配调用栈
+type leakTracker struct {
+	lock    sync.Mutex
+	records map[uintptr]leakRecord
+	stacks  stackTable
+}
+
+func newLeakTracker() *leakTracker {
+	return &leakTracker{records: make(map[uintptr]leakRecord)}
+}
+
+func (t *leakTracker) add(addr, size uintptr, stack *callStack) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.records[addr] = leakRecord{size: size, stack: t.stacks.intern(stack)}
+}
+
+func (t *leakTracker) remove(addr uintptr) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.records, addr)
+}
+
+// move 对象被Compact移动
+func (t *leakTracker) move(old, new uintptr) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if r, ok := t.records[old]; ok {
+		delete(t.records, old)
+		t.records[new] = r
+	}
+}
+
+func (t *leakTracker) report() Leaks {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	group := make(map[int32]*Leak)
+	for _, r := range t.records {
+		l, ok := group[r.stack]
+		if !ok {
+			l = &Leak{Stack: append([]uintptr(nil), t.stacks.pcs(r.stack)...)}
+			group[r.stack] = l
+		}
+		l.Count++
+		l.Bytes += r.size
+	}
+	leaks := make(Leaks, 0, len(group))
+	for _, l := range group {
+		leaks = append(leaks, *l)
+	}
+	sort.Slice(leaks, func(i, j int) bool {
+		if leaks[i].Bytes != leaks[j].Bytes {
+			return leaks[i].Bytes > leaks[j].Bytes
+		}
+		return leaks[i].Count > leaks[j].Count
+	})
+	return leaks
+}
+
+// Leak 同一个调用栈分配的、尚未释放的对象
+type Leak struct {
+	Stack []uintptr // 分配调用栈的PC，可以用runtime.CallersFrames解析
+	Count int
+	Bytes uintptr
+}
+
+func (l Leak) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d bytes in %d objects allocated at:\n", l.Bytes, l.Count)
+	frames := runtime.CallersFrames(l.Stack)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "\t%s\n\t\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// Leaks LeakReport的结果，按Bytes从大到小排序
+type Leaks []Leak
+
+// Bytes 所有未释放对象的字节数
+func (ls Leaks) Bytes() uintptr {
+	var total uintptr
+	for _, l := range ls {
+		total += l.Bytes
+	}
+	return total
+}
+
+// Count 所有未释放对象的个数
+func (ls Leaks) Count() int {
+	var total int
+	for _, l := range ls {
+		total += l.Count
+	}
+	return total
+}
+
+func (ls Leaks) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d bytes in %d objects not freed\n", ls.Bytes(), ls.Count())
+	for _, l := range ls {
+		b.WriteString(l.String())
+	}
+	return b.String()
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"strings"
+	"testing"
+)
+
+func leakyAlloc(m XMemory, t *testing.T) uintptr {
+	p, err := m.Alloc(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uintptr(p)
+}
+
+func TestLeakReport(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemoryWithOptions(0.75, Options{TrackLeaks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []uintptr
+	for i := 0; i < 10; i++ {
+		addrs = append(addrs, leakyAlloc(m, t))
+	}
+	s, err := m.From("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, _, err := m.From2("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := m.AllocSlice(8, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := m.RawAlloc(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaks := m.LeakReport()
+	if leaks.Count() != 14 || len(leaks) != 5 {
+		t.Fatal(leaks)
+	}
+	if leaks[0].Bytes != _PageSize || leaks[1].Count != 10 || leaks[1].Bytes != 1000 {
+		t.Fatal(leaks)
+	}
+	if !strings.Contains(leaks[1].String(), "leakyAlloc") {
+		t.Fatal(leaks[1].String())
+	}
+
+	for _, addr := range addrs {
+		if err := m.Free(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.FreeString(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.FreeString(s1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Free(uintptr(sl)); err != nil {
+		t.Fatal(err)
+	}
+	if leaks := m.LeakReport(); len(leaks) != 1 || leaks[0].Stack == nil || leaks[0].Bytes != chunk.Npages*_PageSize {
+		t.Fatal(leaks)
+	}
+}
+
+func TestLeakReportDisabled(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leakyAlloc(m, t)
+	if leaks := m.LeakReport(); leaks != nil {
+		t.Fatal(leaks)
+	}
+}
@@ -20,6 +20,7 @@ package xmm
 
 import (
 	"errors"
+	"fmt"
 	"runtime"
 	"syscall"
 	"unsafe"
@@ -38,9 +39,10 @@ var (
 )
 
 type linearAlloc struct {
-	next   uintptr // next free byte
-	mapped uintptr // one byte past end of mapped space
-	end    uintptr // end of reserved space
+	next   uintptr   // next free byte
+	mapped uintptr   // one byte past end of mapped space
+	end    uintptr   // end of reserved space
+	advice memAdvice // mlock/madvise applied to every mapped region
 }
 
 func (l *linearAlloc) init(size uintptr) error {
@@ -107,7 +109,7 @@ func (l *linearAlloc) sysMap(addr unsafe.Pointer, length uintptr) error {
 	if uintptr(addr) != v || err != 0 {
 		return errors.New("runtime: cannot map pages in arena address space")
 	}
-	return nil
+	return l.advice.apply(uintptr(addr), length)
 }
 
 func (l *linearAlloc) errnoErr(e syscall.Errno) error {
@@ -188,6 +190,14 @@ retry:
 	}
 }
 
+// sysProtect 修改[addr, addr+length)的访问权限(mprotect)
+func sysProtect(addr, length uintptr, prot int) error {
+	if _, _, e := syscall.Syscall(syscall.SYS_MPROTECT, addr, length, uintptr(prot)); e != 0 {
+		return fmt.Errorf("mprotect addr(%d) length(%d) prot(%d) err: %w", addr, length, prot, e)
+	}
+	return nil
+}
+
 func (l *linearAlloc) sysFree(addr unsafe.Pointer, length uintptr) (err error) {
 	_, _, e1 := syscall.Syscall(syscall.SYS_MUNMAP, uintptr(addr), length, 0)
 	if e1 != 0 {
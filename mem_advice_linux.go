@@ -0,0 +1,66 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+//go:build linux
+// +build linux
+
+package xmm
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	_MADV_DONTFORK   = 10
+	_MADV_DONTDUMP   = 16
+	_MADV_WIPEONFORK = 18
+
+	_RLIMIT_MEMLOCK = 8
+)
+
+func (a memAdvice) apply(addr, length uintptr) error {
+	if a == 0 || length == 0 {
+		return nil
+	}
+	if a&adviceMlock != 0 {
+		if _, _, e := syscall.Syscall(syscall.SYS_MLOCK, addr, length, 0); e != 0 {
+			var rlim syscall.Rlimit
+			syscall.Getrlimit(_RLIMIT_MEMLOCK, &rlim)
+			return &MlockError{Addr: addr, Length: length, Limit: rlim.Cur, Err: e}
+		}
+	}
+	advices := []struct {
+		flag   memAdvice
+		advice uintptr
+		name   string
+	}{
+		{adviceDontDump, _MADV_DONTDUMP, "MADV_DONTDUMP"},
+		{adviceDontFork, _MADV_DONTFORK, "MADV_DONTFORK"},
+		{adviceWipeOnFork, _MADV_WIPEONFORK, "MADV_WIPEONFORK"},
+	}
+	for _, adv := range advices {
+		if a&adv.flag == 0 {
+			continue
+		}
+		if _, _, e := syscall.Syscall(syscall.SYS_MADVISE, addr, length, adv.advice); e != 0 {
+			return fmt.Errorf("madvise(%s) addr(%d) length(%d) err: %w", adv.name, addr, length, e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+//go:build !linux
+// +build !linux
+
+package xmm
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func (a memAdvice) apply(addr, length uintptr) error {
+	if a == 0 || length == 0 {
+		return nil
+	}
+	return fmt.Errorf("mlock/madvise options are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Options XMemory的可选配置，零值为默认行为。
+// 注意：Mlock/DontDump/DontFork/WipeOnFork除了作用于本堆的内存，也作用于元数据(span、bitmap等)；
+// 元数据内存是进程内所有堆共享的，任意一个堆开启后，之后所有堆新映射的元数据都会带上这些选项，且不能撤销。
+// 因此一个堆开启了DontFork后，其他堆不能再开启WipeOnFork(反之亦然)，返回MetadataAdviceConflictError
+type Options struct {
+	// Mlock 锁定堆内存，禁止被swap。受RLIMIT_MEMLOCK限制，超限时返回*MlockError。
+	// 共享的元数据内存也会被锁定，对其他堆同样生效
+	Mlock bool
+
+	// DontDump 堆内存不写入core dump(MADV_DONTDUMP)，共享的元数据内存同样不写入
+	DontDump bool
+
+	// DontFork fork出的子进程中不映射堆内存(MADV_DONTFORK)。
+	// 共享的元数据内存同样不映射，子进程中其他堆也不可用
+	DontFork bool
+
+	// WipeOnFork fork出的子进程中堆内存被清零(MADV_WIPEONFORK)，不能和DontFork同时使用。共享的元数据内存同样被清零
+	WipeOnFork bool
+
+	// GuardPages 保护页调试模式：大对象(以及RawAlloc)独占页并右对齐到PROT_NONE保护页，越界立即SIGSEGV；
+	// 释放后的页同样被保护且不再复用，用于发现use-after-free。很慢，只在测试中排查内存踩踏时使用
+	GuardPages bool
+
+	// GuardAll GuardPages模式下所有对象(包括小对象)都使用保护页分配
+	GuardAll bool
+
+	// Poison 毒化调试模式：Free时填充毒化字节，分配时在请求大小到classSize之间写入canary，
+	// Free和sweep时校验，发现的问题通过OnCorruption报告，Free同时返回*CorruptionError
+	Poison bool
+
+	// Quarantine Poison模式下释放的对象在隔离区中停留的Free次数，之后才允许sweep复用
+	Quarantine int
+
+	// OnCorruption Poison模式发现内存破坏时回调，默认打印日志
+	OnCorruption func(err *CorruptionError)
+
+	// TrackLeaks 记录每个存活对象的分配调用栈，通过XMemory.LeakReport查看未释放的对象
+	TrackLeaks bool
+
+	// ProfileRate 分配采样间隔(平均每分配ProfileRate字节采样一次)，0为关闭，1为记录所有分配。
+	// 通过XMemory.WriteHeapProfile导出，用go tool pprof查看
+	ProfileRate int
+
+	// TrackSizes 记录每个对象请求的大小(每个slot 2字节)，FragmentationReport据此计算内部碎片
+	TrackSizes bool
+
+	// SizeClasses 自定义size class的对象大小，nil为默认表(见DefaultSizeClasses、GenerateSizeClasses)。
+	// 大小需要是8的倍数，大于1024的需要是128的倍数，最大的必须是32768，最多255个，返回SizeClassError
+	SizeClasses []uintptr
+
+	// SizeSamples 记录前SizeSamples次分配的请求大小(warm-up)，0为关闭。通过XMemory.SizeProfile查看
+	SizeSamples int
+
+	// CompactSparseFactor span中存活对象的比例不超过该值时，Compact把其中的对象搬到其他span。
+	// 取值(0, 1]，0为DefaultCompactSparseFactor
+	CompactSparseFactor float64
+}
+
+func (o *Options) check() error {
+	if o.DontFork && o.WipeOnFork {
+		return errors.New("DontFork and WipeOnFork can not be used together")
+	}
+	if o.GuardAll && !o.GuardPages {
+		return errors.New("GuardAll requires GuardPages")
+	}
+	if o.Quarantine < 0 || (o.Quarantine > 0 && !o.Poison) {
+		return errors.New("Quarantine must be >= 0 and requires Poison")
+	}
+	if o.SizeSamples < 0 {
+		return errors.New("SizeSamples must be >= 0")
+	}
+	if o.ProfileRate < 0 {
+		return errors.New("ProfileRate must be >= 0")
+	}
+	if o.CompactSparseFactor < 0 || o.CompactSparseFactor > 1 {
+		return errors.New("CompactSparseFactor must be in [0, 1]")
+	}
+	return nil
+}
+
+func (o *Options) advice() memAdvice {
+	var a memAdvice
+	if o.Mlock {
+		a |= adviceMlock
+	}
+	if o.DontDump {
+		a |= adviceDontDump
+	}
+	if o.DontFork {
+		a |= adviceDontFork
+	}
+	if o.WipeOnFork {
+		a |= adviceWipeOnFork
+	}
+	return a
+}
+
+// memAdvice 每次映射内存(堆的RawMemory、元数据xRawMemory)后需要执行的mlock/madvise
+type memAdvice uint32
+
+const (
+	adviceMlock memAdvice = 1 << iota
+	adviceDontDump
+	adviceDontFork
+	adviceWipeOnFork
+)
+
+// MlockError mlock失败，一般是RLIMIT_MEMLOCK太小(没有CAP_IPC_LOCK时)
+type MlockError struct {
+	Addr   uintptr
+	Length uintptr
+	Limit  uint64 // RLIMIT_MEMLOCK soft limit，单位byte
+	Err    error
+}
+
+func (e *MlockError) Error() string {
+	return fmt.Sprintf("mlock addr(%d) length(%d) failed, RLIMIT_MEMLOCK(%d) may be too low: %s", e.Addr, e.Length, e.Limit, e.Err)
+}
+
+func (e *MlockError) Unwrap() error {
+	return e.Err
+}
+
+var MetadataAdviceConflictError = errors.New("DontFork and WipeOnFork can not be used together on the shared metadata, another heap already uses the other one")
+
+// metadataAdvice 元数据xRawMemory是所有堆共享的(全局pool)，只要有一个堆开启了选项就对之后映射的元数据都生效
+var metadataAdvice uint32
+
+// addMetadataAdvice 合并到全局的元数据选项，DontFork和WipeOnFork不能同时出现在共享的元数据上
+func addMetadataAdvice(a memAdvice) error {
+	for {
+		old := atomic.LoadUint32(&metadataAdvice)
+		merged := memAdvice(old) | a
+		if merged&adviceDontFork != 0 && merged&adviceWipeOnFork != 0 {
+			return MetadataAdviceConflictError
+		}
+		if atomic.CompareAndSwapUint32(&metadataAdvice, old, uint32(merged)) {
+			break
+		}
+	}
+	// 已经映射的元数据内存
+	return pool.advise(a)
+}
+
+func loadMetadataAdvice() memAdvice {
+	return memAdvice(atomic.LoadUint32(&metadataAdvice))
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// vmFlags 读取/proc/self/smaps中包含addr的映射的VmFlags
+func vmFlags(addr uintptr) (string, error) {
+	f, err := os.Open("/proc/self/smaps")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	in := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		var start, end uintptr
+		if n, _ := fmt.Sscanf(line, "%x-%x", &start, &end); n == 2 && strings.Contains(line, " ") {
+			in = addr >= start && addr < end
+			continue
+		}
+		if in && strings.HasPrefix(line, "VmFlags:") {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("addr(%x) not found", addr)
+}
+
+func TestOptionsAdvice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	// 元数据选项是全局的，测试结束后恢复，避免影响之后的测试
+	old := atomic.LoadUint32(&metadataAdvice)
+	defer atomic.StoreUint32(&metadataAdvice, old)
+	f := &Factory{}
+	if _, err := f.CreateMemoryWithOptions(0.75, Options{DontFork: true, WipeOnFork: true}); err == nil {
+		t.Fatal("expect err")
+	}
+	mm, err := f.CreateMemoryWithOptions(0.75, Options{DontDump: true, DontFork: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := mm.Alloc(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := vmFlags(uintptr(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dd: do not include area into core dump   dc: do not copy area on fork
+	if !strings.Contains(flags, " dd") || !strings.Contains(flags, " dc") {
+		t.Fatal(flags)
+	}
+	// 共享的元数据已经是DontFork，其他堆不能再使用WipeOnFork
+	if _, err := f.CreateMemoryWithOptions(0.75, Options{WipeOnFork: true}); !errors.Is(err, MetadataAdviceConflictError) {
+		t.Fatal(err)
+	}
+}
+
+func TestMlockError(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	// 未映射的地址mlock必然失败
+	var la linearAlloc
+	p, err := la.sysReserve(nil, _PageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	la.sysFree(p, _PageSize)
+	err = adviceMlock.apply(uintptr(p), _PageSize)
+	var mlockErr *MlockError
+	if !errors.As(err, &mlockErr) || mlockErr.Length != _PageSize {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Poison调试模式：
+// 1、分配时在请求大小到classSize之间填充canary，Free和sweep时校验，发现写越界
+// 2、Free时用poisonByte填充整个slot，释放后读到的是明显的脏数据
+// 3、释放的对象先进入隔离区，经过Options.Quarantine次Free后才真正标记释放，出隔离区时校验毒化内容，发现释放后写
+
+const (
+	poisonByte = 0xde
+	canaryByte = 0xab
+)
+
+type CorruptionKind uint8
+
+const (
+	CanaryCorrupted CorruptionKind = iota + 1 // canary被改写(写越界)
+	PoisonCorrupted                           // 毒化内容被改写(释放后写)
+	DoubleFree                                // 重复释放
+	InvalidFree                               // 释放的地址不是分配返回的地址
+)
+
+var corruptionKindNames = [...]string{
+	CanaryCorrupted: "canary corrupted",
+	PoisonCorrupted: "poison corrupted",
+	DoubleFree:      "double free",
+	InvalidFree:     "invalid free",
+}
+
+func (k CorruptionKind) String() string {
+	if int(k) < len(corruptionKindNames) && corruptionKindNames[k] != "" {
+		return corruptionKindNames[k]
+	}
+	return fmt.Sprintf("CorruptionKind(%d)", k)
+}
+
+// CorruptionError Poison模式发现的内存破坏
+type CorruptionError struct {
+	Kind      CorruptionKind
+	Addr      uintptr // 对象地址
+	Offset    uintptr // 第一个被破坏的字节相对Addr的偏移
+	SizeClass uint8
+	Size      uintptr // 请求的大小，未知时为0
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("xmm: %s addr(%d) offset(%d) sizeclass(%d) size(%d)", e.Kind, e.Addr, e.Offset, e.SizeClass, e.Size)
+}
+
+// heapDebug Poison模式的状态
+type heapDebug struct {
+	lock        sync.Mutex
+	sizes       map[uintptr]uintptr // 已分配对象地址 -> 请求大小
+	quarantine  []uintptr           // 隔离区(环形)
+	head        int
+	quarantined map[uintptr]struct{}
+	report      func(err *CorruptionError)
+}
+
+func newHeapDebug(opts *Options) *heapDebug {
+	report := opts.OnCorruption
+	if report == nil {
+		report = func(err *CorruptionError) { log.Printf("ERR %s\n", err) }
+	}
+	return &heapDebug{sizes: make(map[uintptr]uintptr), quarantine: make([]uintptr, opts.Quarantine),
+		quarantined: make(map[uintptr]struct{}), report: report}
+}
+
+// slotOf addr所在slot的起始地址和大小，大对象的slot是整个span
+func slotOf(span *xSpan, addr uintptr) (base, size uintptr) {
+	if span.classIndex == 0 {
+		return span.startAddr, span.npages * _PageSize
+	}
+	return span.base() + span.objIndex(addr)*span.classSize, span.classSize
+}
+
+func fillBytes(addr, size uintptr, b byte) {
+	buf := rawBytes(addr, size)
+	for i := range buf {
+		buf[i] = b
+	}
+}
+
+// checkBytes 返回第一个不等于b的字节偏移
+func checkBytes(addr, size uintptr, b byte) (offset uintptr, ok bool) {
+	for i, v := range rawBytes(addr, size) {
+		if v != b {
+			return uintptr(i), false
+		}
+	}
+	return 0, true
+}
+
+func (d *heapDebug) onAlloc(span *xSpan, addr, size uintptr) {
+	if span.guarded {
+		return
+	}
+	_, slotSize := slotOf(span, addr)
+	fillBytes(addr+size, slotSize-size, canaryByte)
+	d.lock.Lock()
+	d.sizes[addr] = size
+	d.lock.Unlock()
+}
+
+// free 校验canary、毒化slot并放入隔离区，挤出隔离区的对象才真正释放
+func (d *heapDebug) free(xh *xHeap, span *xSpan, addr uintptr) error {
+	base, slotSize := slotOf(span, addr)
+	d.lock.Lock()
+	size, ok := d.sizes[addr]
+	if !ok {
+		kind := InvalidFree
+		if _, has := d.quarantined[addr]; has || (addr == base && span.markBitsForIndex(span.objIndex(addr)).isMarked()) {
+			kind = DoubleFree
+		}
+		d.lock.Unlock()
+		err := &CorruptionError{Kind: kind, Addr: addr, SizeClass: uint8(span.classIndex)}
+		d.report(err)
+		return err
+	}
+	delete(d.sizes, addr)
+	var corrupt *CorruptionError
+	if offset, ok := checkBytes(addr+size, slotSize-size, canaryByte); !ok {
+		corrupt = &CorruptionError{Kind: CanaryCorrupted, Addr: addr, Offset: size + offset, SizeClass: uint8(span.classIndex), Size: size}
+	}
+	fillBytes(base, slotSize, poisonByte)
+	evict, has := d.push(addr)
+	d.lock.Unlock()
+	if corrupt != nil {
+		d.report(corrupt)
+	}
+	if has {
+		// 释放可能触发sweep，不能持有d.lock
+		if err := d.release(xh, evict); err != nil {
+			return err
+		}
+	}
+	if corrupt != nil {
+		return corrupt
+	}
+	return nil
+}
+
+// push 放入隔离区，返回被挤出的地址
+func (d *heapDebug) push(addr uintptr) (uintptr, bool) {
+	if len(d.quarantine) == 0 {
+		return addr, true
+	}
+	old := d.quarantine[d.head]
+	d.quarantine[d.head] = addr
+	d.head = (d.head + 1) % len(d.quarantine)
+	d.quarantined[addr] = struct{}{}
+	if old == 0 {
+		return 0, false
+	}
+	delete(d.quarantined, old)
+	return old, true
+}
+
+func (d *heapDebug) isQuarantined(addr uintptr) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, ok := d.quarantined[addr]
+	return ok
+}
+
+// release 校验毒化内容后真正释放
+func (d *heapDebug) release(xh *xHeap, addr uintptr) error {
+	span, err := xh.spanOf(addr)
+	if err != nil {
+		return err
+	}
+	base, slotSize := slotOf(span, addr)
+	if offset, ok := checkBytes(base, slotSize, poisonByte); !ok {
+		d.report(&CorruptionError{Kind: PoisonCorrupted, Addr: addr, Offset: base + offset - addr, SizeClass: uint8(span.classIndex)})
+	}
+	return xh.free(addr)
+}
+
+// checkSpan sweep时校验span中存活对象的canary和已释放对象的毒化内容
+func (d *heapDebug) checkSpan(span *xSpan) {
+	if span.guarded {
+		return
+	}
+	var errs []*CorruptionError
+	slotSize := span.classSize
+	if span.classIndex == 0 {
+		slotSize = span.npages * _PageSize
+	}
+	d.lock.Lock()
+	for i := uintptr(0); i < span.nelems; i++ {
+		addr := span.base() + i*slotSize
+		if size, ok := d.sizes[addr]; ok {
+			if offset, ok := checkBytes(addr+size, slotSize-size, canaryByte); !ok {
+				errs = append(errs, &CorruptionError{Kind: CanaryCorrupted, Addr: addr, Offset: size + offset, SizeClass: uint8(span.classIndex), Size: size})
+			}
+		} else if span.markBitsForIndex(i).isMarked() {
+			if offset, ok := checkBytes(addr, slotSize, poisonByte); !ok {
+				errs = append(errs, &CorruptionError{Kind: PoisonCorrupted, Addr: addr, Offset: offset, SizeClass: uint8(span.classIndex)})
+			}
+		}
+	}
+	d.lock.Unlock()
+	for _, err := range errs {
+		d.report(err)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"testing"
+	"unsafe"
+)
+
+func TestPoison(t *testing.T) {
+	var reports []*CorruptionError
+	f := &Factory{}
+	m, err := f.CreateMemoryWithOptions(0.75, Options{Poison: true, Quarantine: 2,
+		OnCorruption: func(err *CorruptionError) { reports = append(reports, err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc := func(size uintptr) *[1 << 16]byte {
+		p, err := m.Alloc(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return (*[1 << 16]byte)(p)
+	}
+	addr := func(b *[1 << 16]byte) uintptr { return uintptr(unsafe.Pointer(b)) }
+
+	// 写越界
+	a := alloc(20)
+	if a[20] != canaryByte || a[23] != canaryByte {
+		t.Fatal("canary not set", a[20])
+	}
+	a[21] = 1
+	var ce *CorruptionError
+	if err := m.Free(addr(a)); !errors.As(err, &ce) || ce.Kind != CanaryCorrupted || ce.Addr != addr(a) || ce.Offset != 21 || ce.Size != 20 || ce.SizeClass == 0 {
+		t.Fatal(err)
+	}
+	if a[0] != poisonByte || a[19] != poisonByte {
+		t.Fatal("not poisoned")
+	}
+	// 隔离区中重复释放
+	if err := m.Free(addr(a)); !errors.As(err, &ce) || ce.Kind != DoubleFree {
+		t.Fatal(err)
+	}
+	if err := m.Free(addr(a) + 8); !errors.As(err, &ce) || ce.Kind != InvalidFree {
+		t.Fatal(err)
+	}
+
+	// 释放后写，出隔离区时发现
+	b := alloc(16)
+	if err := m.Free(addr(b)); err != nil {
+		t.Fatal(err)
+	}
+	b[3] = 7
+	reports = nil
+	for i := 0; i < 2; i++ {
+		if err := m.Free(addr(alloc(16))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reports) != 1 || reports[0].Kind != PoisonCorrupted || reports[0].Addr != addr(b) || reports[0].Offset != 3 {
+		t.Fatal(reports)
+	}
+
+	// sweep校验存活对象
+	c := alloc(30)
+	c[31] = 0
+	span, err := m.(*mm).h.spanOf(addr(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports = nil
+	m.(*mm).h.debug.checkSpan(span)
+	if len(reports) != 1 || reports[0].Kind != CanaryCorrupted || reports[0].Addr != addr(c) || reports[0].Offset != 31 {
+		t.Fatal(reports)
+	}
+
+	// 大对象
+	big, err := m.Alloc(_MaxSmallSize + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *(*byte)(unsafe.Pointer(uintptr(big) + _MaxSmallSize + 1)) != canaryByte {
+		t.Fatal("large canary not set")
+	}
+	if err := m.Free(uintptr(big)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoisonOptions(t *testing.T) {
+	f := &Factory{}
+	if _, err := f.CreateMemoryWithOptions(0.75, Options{Quarantine: 1}); err == nil {
+		t.Fatal("Quarantine without Poison")
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// DefaultPoolIdleTimeout Pool中没有对象在使用的span空闲多久后还给堆
+const DefaultPoolIdleTimeout = time.Minute
+
+var PoolClosedError = errors.New("pool is closed")
+
+// Pool 类似sync.Pool的对象池，对象存放在XMM内存中，对Go GC不可见(T中不能保存Go指针)。
+// Pool独占T所在size class的span，Put的对象直接复用，不经过mark/sweep；没有对象在使用的span空闲超过idleTimeout后还给堆。
+// Pool的span不在span链表中，Walk、Verify、Snapshot看不到Pool中的对象
+type Pool[T any] struct {
+	heap        *xHeap
+	classSpan   *xClassSpan
+	spanFact    float32
+	size        uintptr
+	reset       func(*T)
+	idleTimeout time.Duration
+
+	lock    sync.Mutex
+	spans   map[*xSpan]*poolSpan
+	partial []*poolSpan // 还有空闲slot的span
+	timer   *time.Timer
+	closed  bool
+}
+
+// poolSpan Pool独占的span，slot的分配状态保存在Go内存中(不含指针)
+type poolSpan struct {
+	span      *xSpan
+	next      uintptr  // 还没有分配过的第一个slot
+	free      []uint32 // Put回来的slot
+	used      []uint64 // slot是否在使用，用于发现重复Put
+	inuse     uintptr
+	idleSince time.Time // inuse变为0的时间
+	partial   bool      // 是否在Pool.partial中
+}
+
+// PoolStats Pool的统计
+type PoolStats struct {
+	Spans   int     // 持有的span数
+	InUse   uintptr // 在使用的对象数
+	Free    uintptr // 可以直接复用的slot数
+	Objects uintptr // 所有span的slot数
+}
+
+// NewPool 创建对象池。reset不为nil时Put时调用reset(不能在其中调用Pool的方法)，否则把对象清零；idleTimeout为0时使用DefaultPoolIdleTimeout
+func NewPool[T any](m XMemory, reset func(*T), idleTimeout time.Duration) (*Pool[T], error) {
+	mm, ok := m.(*mm)
+	if !ok {
+		return nil, errors.New("XMemory is not support pool")
+	}
+	var t T
+	size := unsafe.Sizeof(t)
+	if size == 0 || size > _MaxSmallSize {
+		return nil, fmt.Errorf("size(%d) of T is not support", size)
+	}
+	if idleTimeout < 0 {
+		return nil, NilError
+	}
+	if idleTimeout == 0 {
+		idleTimeout = DefaultPoolIdleTimeout
+	}
+	sp, ok := mm.sp.(*xSpanPool)
+	if !ok {
+		return nil, errors.New("spanPool is not support pool")
+	}
+	class := mm.h.classes.sizeToClass(size)
+	return &Pool[T]{heap: mm.h, classSpan: mm.h.classSpan[class], spanFact: sp.spanFact, size: size,
+		reset: reset, idleTimeout: idleTimeout, spans: make(map[*xSpan]*poolSpan)}, nil
+}
+
+// Get 取出一个对象：优先复用Put回来的，否则返回清零的新对象
+func (p *Pool[T]) Get() (*T, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil, PoolClosedError
+	}
+	if len(p.partial) == 0 {
+		span, err := p.classSpan.newSpan(p.spanFact)
+		if err != nil {
+			return nil, err
+		}
+		ps := &poolSpan{span: span, used: make([]uint64, (span.nelems+63)/64), partial: true}
+		p.spans[span] = ps
+		p.partial = append(p.partial, ps)
+	}
+	ps := p.partial[len(p.partial)-1]
+	var i uintptr
+	fresh := len(ps.free) == 0
+	if fresh {
+		i = ps.next
+		ps.next++
+	} else {
+		n := len(ps.free)
+		i, ps.free = uintptr(ps.free[n-1]), ps.free[:n-1]
+	}
+	ps.used[i/64] |= 1 << (i % 64)
+	ps.inuse++
+	if len(ps.free) == 0 && ps.next == ps.span.nelems {
+		p.partial = p.partial[:len(p.partial)-1]
+		ps.partial = false
+	}
+	addr := ps.span.base() + i*ps.span.classSize
+	if fresh {
+		// newSpan的页可能来自关闭的Pool或释放的span，有旧数据
+		clearBytes(addr, p.size)
+	}
+	return (*T)(unsafe.Pointer(addr)), nil
+}
+
+// Put 归还Get得到的对象
+func (p *Pool[T]) Put(obj *T) error {
+	if obj == nil {
+		return NilError
+	}
+	addr := uintptr(unsafe.Pointer(obj))
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return PoolClosedError
+	}
+	span, err := p.heap.spanOf(addr)
+	if err != nil {
+		return err
+	}
+	ps, ok := p.spans[span]
+	if !ok || (addr-span.base())%span.classSize != 0 {
+		return fmt.Errorf("addr(%d) is not from this pool", addr)
+	}
+	i := (addr - span.base()) / span.classSize
+	if ps.used[i/64]&(1<<(i%64)) == 0 {
+		return fmt.Errorf("addr(%d) is put twice", addr)
+	}
+	// 在锁内reset，reset中不能调用Pool的方法
+	if p.reset != nil {
+		p.reset(obj)
+	} else {
+		clearBytes(addr, p.size)
+	}
+	ps.used[i/64] &^= 1 << (i % 64)
+	ps.free = append(ps.free, uint32(i))
+	ps.inuse--
+	if !ps.partial {
+		p.partial = append(p.partial, ps)
+		ps.partial = true
+	}
+	if ps.inuse == 0 {
+		ps.idleSince = time.Now()
+		if p.timer == nil {
+			p.timer = time.AfterFunc(p.idleTimeout, p.trim)
+		}
+	}
+	return nil
+}
+
+// trim 释放空闲超过idleTimeout的span，还有空闲的span时重新定时
+func (p *Pool[T]) trim() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.timer = nil
+	if p.closed {
+		return
+	}
+	now := time.Now()
+	var next time.Duration
+	for _, ps := range p.partial {
+		if ps.inuse > 0 {
+			continue
+		}
+		if idle := now.Sub(ps.idleSince); idle < p.idleTimeout {
+			if wait := p.idleTimeout - idle; next == 0 || wait < next {
+				next = wait
+			}
+			continue
+		}
+		if err := p.release(ps); err != nil {
+			log.Printf("Pool.trim release span err:%s\n", err)
+		}
+	}
+	partial := p.partial[:0]
+	for _, ps := range p.partial {
+		if ps.partial {
+			partial = append(partial, ps)
+		}
+	}
+	p.partial = partial
+	if next > 0 {
+		p.timer = time.AfterFunc(next, p.trim)
+	}
+}
+
+// release 把span还给堆，调用方需要从partial中去掉
+func (p *Pool[T]) release(ps *poolSpan) error {
+	delete(p.spans, ps.span)
+	ps.partial = false
+	return p.heap.releasePages(ps.span)
+}
+
+// Stats 返回Pool的统计
+func (p *Pool[T]) Stats() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var s PoolStats
+	for _, ps := range p.spans {
+		s.Spans++
+		s.InUse += ps.inuse
+		s.Objects += ps.span.nelems
+		s.Free += ps.span.nelems - ps.inuse
+	}
+	return s
+}
+
+// Close 把所有span还给堆，之前Get的对象不能再使用
+func (p *Pool[T]) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	for _, ps := range p.spans {
+		if err := p.release(ps); err != nil {
+			return err
+		}
+	}
+	p.partial = nil
+	return nil
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type poolItem struct {
+	id    int
+	count int
+	buf   [40]byte
+}
+
+func TestPool(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resets int
+	p, err := NewPool[poolItem](m, func(item *poolItem) {
+		resets++
+		item.count = 0
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.id != 0 || a.count != 0 {
+		t.Fatal(*a)
+	}
+	a.id, a.count = 7, 3
+	if err := p.Put(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put(a); err == nil {
+		t.Fatal("put twice")
+	}
+	// 复用同一个slot，reset只清了count
+	b, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != a || b.id != 7 || b.count != 0 || resets != 1 {
+		t.Fatal(b, a, *b, resets)
+	}
+	other, err := m.Alloc(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put((*poolItem)(other)); err == nil {
+		t.Fatal("put object not from pool")
+	}
+
+	items := make(map[*poolItem]bool)
+	for i := 0; i < 1000; i++ {
+		item, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if items[item] || item == b {
+			t.Fatal("duplicate", item)
+		}
+		items[item] = true
+		item.id = i
+	}
+	s := p.Stats()
+	if s.InUse != 1001 || s.Spans < 2 || s.Objects != s.InUse+s.Free {
+		t.Fatalf("%+v", s)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get(); err != PoolClosedError {
+		t.Fatal(err)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPoolReuseAfterClose 关闭的Pool还回去的页被新的Pool复用，新对象仍然是清零的
+func TestPoolReuseAfterClose(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 300
+	p, err := NewPool[poolItem](m, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := make(map[*poolItem]bool)
+	for i := 0; i < n; i++ {
+		item, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.id, item.count = -1, -1
+		for j := range item.buf {
+			item.buf[j] = 0xff
+		}
+		old[item] = true
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, err = NewPool[poolItem](m, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var reused int
+	for i := 0; i < n; i++ {
+		item, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if old[item] {
+			reused++
+		}
+		if *item != (poolItem{}) {
+			t.Fatal("dirty object", *item)
+		}
+	}
+	if reused == 0 {
+		t.Fatal("pages of the closed pool are not reused")
+	}
+}
+
+func TestPoolIdleRelease(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPool[poolItem](m, nil, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []*poolItem
+	for i := 0; i < 500; i++ {
+		item, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.id = i + 1
+		items = append(items, item)
+	}
+	spans := p.Stats().Spans
+	// 保留第一个对象，它所在的span不能释放
+	for _, item := range items[1:] {
+		if err := p.Put(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if items[1].id != 0 {
+		t.Fatal("not zeroed", *items[1])
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Stats().Spans != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s := p.Stats(); s.Spans != 1 || s.InUse != 1 || spans < 2 {
+		t.Fatalf("%d %+v", spans, s)
+	}
+	if items[0].id != 1 {
+		t.Fatal(*items[0])
+	}
+	// 释放的页还给了堆
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Alloc(100); err != nil {
+		t.Fatal(err)
+	}
+	item, err := p.Get()
+	if err != nil || item.id != 0 {
+		t.Fatal(item, err)
+	}
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPool[poolItem](m, nil, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			held := make(map[*poolItem]int)
+			for i := 0; i < 2000; i++ {
+				item, err := p.Get()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if item.id != 0 {
+					t.Error("reused object is not zeroed")
+					return
+				}
+				item.id = g*10000 + i + 1
+				held[item] = item.id
+				if i%3 == 0 {
+					for h, id := range held {
+						if h.id != id {
+							t.Error("object is shared")
+						}
+						if err := p.Put(h); err != nil {
+							t.Error(err)
+							return
+						}
+						delete(held, h)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,321 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ProfileDisabledError = errors.New("allocation profiling is disabled, set Options.ProfileRate")
+
+// allocProfiler 按字节采样的分配profile，和runtime.MemProfileRate的采样方式一致：
+// 采样间隔服从均值为rate的指数分布，导出时按 1/(1-exp(-size/rate)) 还原
+type allocProfiler struct {
+	rate      int64
+	remaining int64 // 距离下一次采样还需要分配的字节数
+
+	lock    sync.Mutex
+	samples map[uintptr]profRecord // 被采样且尚未释放的对象
+	buckets map[int32]*profBucket  // 调用栈 -> 统计
+	stacks  stackTable
+	start   time.Time
+}
+
+type profRecord struct {
+	size  uintptr
+	stack int32
+}
+
+type profBucket struct {
+	allocs, allocBytes int64
+	frees, freeBytes   int64
+}
+
+func newAllocProfiler(rate int) *allocProfiler {
+	p := &allocProfiler{rate: int64(rate), samples: make(map[uintptr]profRecord),
+		buckets: make(map[int32]*profBucket), start: time.Now()}
+	p.remaining = p.nextSample()
+	return p
+}
+
+func (p *allocProfiler) nextSample() int64 {
+	if p.rate <= 1 {
+		return 0
+	}
+	return int64(rand.ExpFloat64()*float64(p.rate)) + 1
+}
+
+// sample 是否采样这次分配
+func (p *allocProfiler) sample(size uintptr) bool {
+	if atomic.AddInt64(&p.remaining, -int64(size)) > 0 {
+		return false
+	}
+	atomic.StoreInt64(&p.remaining, p.nextSample())
+	return true
+}
+
+func (p *allocProfiler) add(addr, size uintptr, stack *callStack) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id := p.stacks.intern(stack)
+	b, ok := p.buckets[id]
+	if !ok {
+		b = &profBucket{}
+		p.buckets[id] = b
+	}
+	b.allocs++
+	b.allocBytes += int64(size)
+	p.samples[addr] = profRecord{size: size, stack: id}
+}
+
+func (p *allocProfiler) remove(addr uintptr) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	r, ok := p.samples[addr]
+	if !ok {
+		return
+	}
+	delete(p.samples, addr)
+	b := p.buckets[r.stack]
+	b.frees++
+	b.freeBytes += int64(r.size)
+}
+
+// move 对象被Compact移动
+func (p *allocProfiler) move(old, new uintptr) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if r, ok := p.samples[old]; ok {
+		delete(p.samples, old)
+		p.samples[new] = r
+	}
+}
+
+// scale 采样值还原为估计值，同runtime/pprof.scaleHeapSample
+func (p *allocProfiler) scale(count, size int64) (int64, int64) {
+	if count == 0 || size == 0 {
+		return 0, 0
+	}
+	if p.rate <= 1 {
+		return count, size
+	}
+	avgSize := float64(size) / float64(count)
+	s := 1 / (1 - math.Exp(-avgSize/float64(p.rate)))
+	return int64(float64(count) * s), int64(float64(size) * s)
+}
+
+func (m *mm) WriteHeapProfile(w io.Writer) error {
+	if m.prof == nil {
+		return ProfileDisabledError
+	}
+	return m.prof.write(w)
+}
+
+// write 输出gzip压缩的profile.proto，字段定义见
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+func (p *allocProfiler) write(w io.Writer) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	b := &profileBuilder{strings: map[string]int64{"": 0}, stringTable: []string{""},
+		locations: make(map[uintptr]uint64), functions: make(map[string]uint64)}
+	for _, t := range [][2]string{{"alloc_objects", "count"}, {"alloc_space", "bytes"}, {"inuse_objects", "count"}, {"inuse_space", "bytes"}} {
+		b.valueType(1, t[0], t[1])
+	}
+	for id, bucket := range p.buckets {
+		allocs, allocBytes := p.scale(bucket.allocs, bucket.allocBytes)
+		inuse, inuseBytes := p.scale(bucket.allocs-bucket.frees, bucket.allocBytes-bucket.freeBytes)
+		locs := make([]uint64, 0, maxStackDepth)
+		for _, pc := range p.stacks.pcs(id) {
+			locs = append(locs, b.location(pc))
+		}
+		values := []uint64{uint64(allocs), uint64(allocBytes), uint64(inuse), uint64(inuseBytes)}
+		b.samples.message(2, func(e *protoEncoder) {
+			e.packed(1, locs)
+			e.packed(2, values)
+		})
+	}
+
+	// 字符串表要在所有引用之后写出
+	b.head.message(11, func(e *protoEncoder) {
+		e.int64(1, b.str("space"))
+		e.int64(2, b.str("bytes"))
+	})
+	out := &protoEncoder{}
+	out.data = append(out.data, b.head.data...)
+	out.data = append(out.data, b.samples.data...)
+	out.data = append(out.data, b.locs.data...)
+	out.data = append(out.data, b.funcs.data...)
+	for _, s := range b.stringTable {
+		out.string(6, s)
+	}
+	out.int64(9, p.start.UnixNano())
+	out.int64(10, time.Since(p.start).Nanoseconds())
+	out.int64(12, p.rate)
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(out.data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// profileBuilder 构造profile.proto，字符串、location、function去重
+type profileBuilder struct {
+	head, samples, locs, funcs protoEncoder
+	strings                    map[string]int64
+	stringTable                []string
+	locations                  map[uintptr]uint64
+	functions                  map[string]uint64
+}
+
+func (b *profileBuilder) str(s string) int64 {
+	if id, ok := b.strings[s]; ok {
+		return id
+	}
+	id := int64(len(b.stringTable))
+	b.strings[s] = id
+	b.stringTable = append(b.stringTable, s)
+	return id
+}
+
+func (b *profileBuilder) valueType(field int, typ, unit string) {
+	b.head.message(field, func(e *protoEncoder) {
+		e.int64(1, b.str(typ))
+		e.int64(2, b.str(unit))
+	})
+}
+
+func (b *profileBuilder) function(frame runtime.Frame) uint64 {
+	if id, ok := b.functions[frame.Function]; ok {
+		return id
+	}
+	id := uint64(len(b.functions) + 1)
+	b.functions[frame.Function] = id
+	b.funcs.message(5, func(e *protoEncoder) {
+		e.uint64(1, id)
+		e.int64(2, b.str(frame.Function))
+		e.int64(3, b.str(frame.Function))
+		e.int64(4, b.str(frame.File))
+	})
+	return id
+}
+
+// location 一个pc对应一个location，内联展开的函数作为多个line
+func (b *profileBuilder) location(pc uintptr) uint64 {
+	if id, ok := b.locations[pc]; ok {
+		return id
+	}
+	id := uint64(len(b.locations) + 1)
+	b.locations[pc] = id
+	type line struct {
+		function uint64
+		line     int64
+	}
+	var lines []line
+	frames := runtime.CallersFrames([]uintptr{pc})
+	for {
+		frame, more := frames.Next()
+		lines = append(lines, line{b.function(frame), int64(frame.Line)})
+		if !more {
+			break
+		}
+	}
+	b.locs.message(4, func(e *protoEncoder) {
+		e.uint64(1, id)
+		e.uint64(3, uint64(pc))
+		for _, l := range lines {
+			e.message(4, func(e *protoEncoder) {
+				e.uint64(1, l.function)
+				e.int64(2, l.line)
+			})
+		}
+	})
+	return id
+}
+
+// protoEncoder 最简单的protobuf编码，只支持varint和length-delimited
+type protoEncoder struct {
+	data []byte
+}
+
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+func (e *protoEncoder) varint(x uint64) {
+	for x >= 0x80 {
+		e.data = append(e.data, byte(x)|0x80)
+		x >>= 7
+	}
+	e.data = append(e.data, byte(x))
+}
+
+func (e *protoEncoder) key(field, wire int) {
+	e.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (e *protoEncoder) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	e.key(field, protoVarint)
+	e.varint(x)
+}
+
+func (e *protoEncoder) int64(field int, x int64) {
+	e.uint64(field, uint64(x))
+}
+
+// string repeated string中的空串也需要写出
+func (e *protoEncoder) string(field int, s string) {
+	e.key(field, protoBytes)
+	e.varint(uint64(len(s)))
+	e.data = append(e.data, s...)
+}
+
+func (e *protoEncoder) packed(field int, xs []uint64) {
+	if len(xs) == 0 {
+		return
+	}
+	var tmp protoEncoder
+	for _, x := range xs {
+		tmp.varint(x)
+	}
+	e.key(field, protoBytes)
+	e.varint(uint64(len(tmp.data)))
+	e.data = append(e.data, tmp.data...)
+}
+
+func (e *protoEncoder) message(field int, fn func(e *protoEncoder)) {
+	var tmp protoEncoder
+	fn(&tmp)
+	e.key(field, protoBytes)
+	e.varint(uint64(len(tmp.data)))
+	e.data = append(e.data, tmp.data...)
+}
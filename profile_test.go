@@ -0,0 +1,98 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWriteHeapProfile(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemoryWithOptions(0.75, Options{ProfileRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []uintptr
+	for i := 0; i < 100; i++ {
+		p, err := m.Alloc(64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, uintptr(p))
+	}
+	for _, addr := range addrs[:40] {
+		if err := m.Free(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prof := m.(*mm).prof
+	if len(prof.buckets) != 1 {
+		t.Fatal(len(prof.buckets))
+	}
+	for _, b := range prof.buckets {
+		if b.allocs != 100 || b.allocBytes != 6400 || b.frees != 40 || b.freeBytes != 2560 {
+			t.Fatal(*b)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := m.WriteHeapProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"alloc_objects", "alloc_space", "inuse_objects", "inuse_space", "TestWriteHeapProfile"} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Fatal("missing", s)
+		}
+	}
+}
+
+func TestProfileSampling(t *testing.T) {
+	p := newAllocProfiler(512 * 1024)
+	var sampled int
+	for i := 0; i < 100000; i++ {
+		if p.sample(1024) {
+			sampled++
+		}
+	}
+	// 平均每512次采样一次
+	if sampled < 100 || sampled > 300 {
+		t.Fatal(sampled)
+	}
+
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteHeapProfile(&bytes.Buffer{}); !errors.Is(err, ProfileDisabledError) {
+		t.Fatal(err)
+	}
+}
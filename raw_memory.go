@@ -42,6 +42,10 @@ func newXRawMemory(byteNum int) (*xRawMemory, error) {
 	}
 	// log.Printf(" newXRawMemory(mmap) byteNum:%d byte \n", byteNum)
 	ptr := unsafe.Pointer(&mem[0])
+	if err := loadMetadataAdvice().apply(uintptr(ptr), uintptr(byteNum)); err != nil {
+		syscall.Munmap(mem)
+		return nil, err
+	}
 	xrm := &xRawMemory{addr: uintptr(ptr), mem: mem}
 	return xrm, nil
 }
@@ -94,6 +98,18 @@ func (xrmp *xRawMemoryPool) alloc(byteSize uintptr) (ptr unsafe.Pointer, err err
 	return unsafe.Pointer(xrmp.xrm.addr + offset), nil
 }
 
+// advise 对已经映射的元数据内存执行mlock/madvise
+func (xrmp *xRawMemoryPool) advise(a memAdvice) error {
+	xrmp.lock.Lock()
+	defer xrmp.lock.Unlock()
+	for xrm := xrmp.xrm; xrm != nil; xrm = xrm.next {
+		if err := a.apply(xrm.addr, uintptr(len(xrm.mem))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (xrmp *xRawMemoryPool) release(block *block) error {
 	xrmp.lock.Lock()
 	defer xrmp.lock.Unlock()
@@ -140,11 +156,14 @@ func (xrmp *xRawMemoryPool) freeOffset(size uintptr) (uintptr, error) {
 	}
 }
 
+const metadataAlign = 8
+
 func (xrmp *xRawMemoryPool) alignOf(size uintptr) (uintptr, error) {
 	if size > metadataRawMemoryBytes {
 		return 0, errors.New("size is over[xRawMemoryPool]")
 	}
-	offset := xrmp.index % metadataRawMemoryBytes
+	// 元数据里有指针和uint64，按8字节对齐，避免前一个奇数大小的分配(如uint16表)让后面的都不对齐
+	offset := Align(xrmp.index%metadataRawMemoryBytes, metadataAlign)
 	if _PageSize-offset%_PageSize < size {
 		// 当前page不够，挪动到下一个page
 		offset = Align(offset, _PageSize)
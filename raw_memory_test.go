@@ -184,3 +184,18 @@ func sysReserve(size int) unsafe.Pointer {
 	ptr := unsafe.Pointer(&mem[0])
 	return ptr
 }
+
+func TestMetadataAlign(t *testing.T) {
+	for _, size := range []uintptr{3, 2, 1, 6} {
+		if _, err := pool.alloc(size); err != nil {
+			t.Fatal(err)
+		}
+		ptr, err := pool.alloc(unsafe.Sizeof(xSpan{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uintptr(ptr)%metadataAlign != 0 {
+			t.Fatalf("metadata %x is not aligned after alloc(%d)", ptr, size)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+var InvalidPtrError = errors.New("pointer is not in xmm heap")
+
+// RelPtr 相对于堆基址编码的指针(位置无关)。
+// XMM内存中的结构体互相引用时使用RelPtr代替裸地址，堆被整体映射到其他地址(持久化、共享、搬迁)后依然有效。
+// 编码为 offset+1，零值表示nil，可以直接存放在XMM内存中。
+type RelPtr uint64
+
+// Offset RelPtr的别名
+type Offset = RelPtr
+
+// IsNil 是否为nil
+func (r RelPtr) IsNil() bool {
+	return r == 0
+}
+
+// From 将p编码为相对于m堆基址的RelPtr，p必须指向m分配的内存。
+func (r *RelPtr) From(m XMemory, p unsafe.Pointer) error {
+	h, err := heapOf(m)
+	if err != nil {
+		return err
+	}
+	rp, err := h.relPtr(uintptr(p))
+	if err != nil {
+		return err
+	}
+	*r = rp
+	return nil
+}
+
+// Resolve 将RelPtr解析为m中的地址，nil解析为nil。
+func (r RelPtr) Resolve(m XMemory) (unsafe.Pointer, error) {
+	h, err := heapOf(m)
+	if err != nil {
+		return nil, err
+	}
+	p, err := h.resolve(r)
+	if err != nil {
+		return nil, err
+	}
+	return unsafe.Pointer(p), nil
+}
+
+func heapOf(m XMemory) (*xHeap, error) {
+	x, ok := m.(*mm)
+	if !ok || x == nil || x.h == nil {
+		return nil, NilError
+	}
+	return x.h, nil
+}
+
+// relPtr 地址 -> RelPtr，地址必须落在某个span的页范围内
+func (xh *xHeap) relPtr(p uintptr) (RelPtr, error) {
+	if p == 0 {
+		return 0, nil
+	}
+	if err := xh.checkAddr(p); err != nil {
+		return 0, err
+	}
+	// 堆扩容的RawMemory可能低于base，这里依赖无符号数回绕，resolve时加回来即可
+	return RelPtr(p-xh.base) + 1, nil
+}
+
+// resolve RelPtr -> 地址
+func (xh *xHeap) resolve(r RelPtr) (uintptr, error) {
+	if r.IsNil() {
+		return 0, nil
+	}
+	p := xh.base + uintptr(r-1)
+	if err := xh.checkAddr(p); err != nil {
+		return 0, err
+	}
+	return p, nil
+}
+
+// checkAddr 校验p是否为堆中span管理的地址
+func (xh *xHeap) checkAddr(p uintptr) error {
+	span, err := xh.spanOf(p)
+	if err != nil {
+		return fmt.Errorf("%w: addr(%d) %s", InvalidPtrError, p, err)
+	}
+	if span == nil || p < span.startAddr || p >= span.startAddr+span.npages*_PageSize {
+		return fmt.Errorf("%w: addr(%d)", InvalidPtrError, p)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"testing"
+	"unsafe"
+)
+
+type relNode struct {
+	Val  int
+	Next RelPtr
+}
+
+func TestRelPtr(t *testing.T) {
+	f := &Factory{}
+	mm, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var head RelPtr
+	for i := 0; i < 1000; i++ {
+		p, err := mm.Alloc(unsafe.Sizeof(relNode{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := (*relNode)(p)
+		node.Val, node.Next = i, head
+		if err := head.From(mm, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 大对象
+	big, err := mm.Alloc(_MaxSmallSize + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bigPtr RelPtr
+	if err := bigPtr.From(mm, unsafe.Pointer(uintptr(big)+100)); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := bigPtr.Resolve(mm); err != nil || uintptr(p) != uintptr(big)+100 {
+		t.Fatal(p, err)
+	}
+
+	cnt := 999
+	for r := head; !r.IsNil(); {
+		p, err := r.Resolve(mm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := (*relNode)(p)
+		if node.Val != cnt {
+			t.Fatal(node.Val, cnt)
+		}
+		cnt--
+		r = node.Next
+	}
+	if cnt != -1 {
+		t.Fatal(cnt)
+	}
+
+	var nilPtr RelPtr
+	if p, err := nilPtr.Resolve(mm); err != nil || p != nil {
+		t.Fatal(p, err)
+	}
+	if err := nilPtr.From(mm, nil); err != nil || !nilPtr.IsNil() {
+		t.Fatal(nilPtr, err)
+	}
+	// go堆上的地址
+	goNode := &relNode{}
+	if err := nilPtr.From(mm, unsafe.Pointer(goNode)); !errors.Is(err, InvalidPtrError) {
+		t.Fatal(err)
+	}
+	// 其他xmm实例的地址
+	mm2, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := mm2.Alloc(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nilPtr.From(mm, p2); !errors.Is(err, InvalidPtrError) {
+		t.Fatal(err)
+	}
+}
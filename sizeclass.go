@@ -0,0 +1,262 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var SizeClassError = errors.New("size classes are illegal")
+
+// maxNumSizeClasses class下标为uint8，包括0号(大对象)
+const maxNumSizeClasses = 256
+
+// sizeClasses 一个堆的size class表，创建堆时由Options.SizeClasses生成，默认使用metadata.go中的表
+type sizeClasses struct {
+	size     []uint16
+	npages   []uint8
+	divmagic []divMagic
+	size8    [smallSizeMax/smallSizeDiv + 1]uint8
+	size128  [(_MaxSmallSize-smallSizeMax)/largeSizeDiv + 1]uint8
+}
+
+var defaultSizeClasses = &sizeClasses{size: class_to_size[:], npages: class_to_allocnpages[:],
+	divmagic: class_to_divmagic[:], size8: size_to_class8, size128: size_to_class128}
+
+// num class个数，包括0号
+func (c *sizeClasses) num() int {
+	return len(c.size)
+}
+
+func (c *sizeClasses) sizeToClass(size uintptr) uint8 {
+	if size <= smallSizeMax-8 {
+		return c.size8[(size+smallSizeDiv-1)/smallSizeDiv]
+	}
+	return c.size128[(size-smallSizeMax+largeSizeDiv-1)/largeSizeDiv]
+}
+
+// spanPages class的span页数
+func (c *sizeClasses) spanPages(class int) uintptr {
+	size := uintptr(c.size[class])
+	return Align(Align(size, _PageSize)/_PageSize, uintptr(c.npages[class]))
+}
+
+// spanDivMagic npages页的span中class的divMagic，页数比spanPages多(见specialPageNumCoefficient)时重新计算
+func (c *sizeClasses) spanDivMagic(class int, npages uintptr) (divMagic, error) {
+	m := c.divmagic[class]
+	if m.baseMask != 0 || npages <= c.spanPages(class) {
+		return m, nil
+	}
+	return computeDivMagic(uintptr(c.size[class]), npages*_PageSize)
+}
+
+// sizes 不包括0号的class大小
+func (c *sizeClasses) sizes() []uintptr {
+	sizes := make([]uintptr, 0, c.num()-1)
+	for _, size := range c.size[1:] {
+		sizes = append(sizes, uintptr(size))
+	}
+	return sizes
+}
+
+// DefaultSizeClasses 默认的size class大小(不包括0号)，可以追加需要的大小后作为Options.SizeClasses
+func DefaultSizeClasses() []uintptr {
+	return defaultSizeClasses.sizes()
+}
+
+// GenerateSizeClasses 按Go runtime mksizeclasses.go的算法生成size class：
+// 对齐逐步放大，每个span尾部浪费不超过1/8，相同页数、相同对象数的class合并为较大的一个
+func GenerateSizeClasses() []uintptr {
+	type class struct {
+		size, npages uintptr
+	}
+	var classes []class
+	align := uintptr(8)
+	for size := align; size <= _MaxSmallSize; size += align {
+		if size&(size-1) == 0 {
+			if size >= 2048 {
+				align = 256
+			} else if size >= 128 {
+				align = size / 8
+			} else if size >= 16 {
+				align = 16
+			}
+		}
+		npages := classPages(size)
+		if n := len(classes); n > 0 && npages == classes[n-1].npages &&
+			npages*_PageSize/size == npages*_PageSize/classes[n-1].size {
+			classes[n-1].size = size
+			continue
+		}
+		classes = append(classes, class{size: size, npages: npages})
+	}
+	sizes := make([]uintptr, 0, len(classes))
+	for _, c := range classes {
+		// 同样的页数能放下同样多的对象时，尽量放大对象
+		psize := c.npages * _PageSize
+		if newSize := (psize / (psize / c.size)) &^ (largeSizeDiv - 1); newSize > c.size && newSize <= _MaxSmallSize {
+			c.size = newSize
+		}
+		// 4K页时放大后可能和后一个class重合
+		if n := len(sizes); n > 0 && sizes[n-1] >= c.size {
+			continue
+		}
+		sizes = append(sizes, c.size)
+	}
+	return sizes
+}
+
+// classPages 让span尾部浪费不超过1/8的最小页数
+func classPages(size uintptr) uintptr {
+	allocSize := uintptr(_PageSize)
+	for allocSize%size > allocSize/8 {
+		allocSize += _PageSize
+	}
+	return allocSize / _PageSize
+}
+
+// newSizeClasses 由class大小生成size class表：排序去重后校验，计算span页数、divmagic和size到class的查找表
+func newSizeClasses(sizes []uintptr) (*sizeClasses, error) {
+	if len(sizes) == 0 {
+		return defaultSizeClasses, nil
+	}
+	sorted := append([]uintptr(nil), sizes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	uniq := sorted[:0]
+	for _, size := range sorted {
+		if len(uniq) == 0 || uniq[len(uniq)-1] != size {
+			uniq = append(uniq, size)
+		}
+	}
+	if err := checkSizeClasses(uniq); err != nil {
+		return nil, err
+	}
+	if equalSizes(uniq, DefaultSizeClasses()) {
+		return defaultSizeClasses, nil
+	}
+	c := &sizeClasses{size: []uint16{0}, npages: []uint8{0}, divmagic: []divMagic{{}}}
+	for _, size := range uniq {
+		npages := classPages(size)
+		if npages > 255 {
+			return nil, fmt.Errorf("%w: size(%d) needs too many pages(%d)", SizeClassError, size, npages)
+		}
+		c.size = append(c.size, uint16(size))
+		c.npages = append(c.npages, uint8(npages))
+		m, err := computeDivMagic(size, c.spanPages(len(c.size)-1)*_PageSize)
+		if err != nil {
+			return nil, err
+		}
+		c.divmagic = append(c.divmagic, m)
+	}
+	c.makeLookup()
+	return c, nil
+}
+
+func checkSizeClasses(sizes []uintptr) error {
+	if len(sizes)+1 > maxNumSizeClasses {
+		return fmt.Errorf("%w: too many classes(%d), max %d", SizeClassError, len(sizes), maxNumSizeClasses-1)
+	}
+	for _, size := range sizes {
+		if size == 0 || size%smallSizeDiv != 0 {
+			return fmt.Errorf("%w: size(%d) is not a multiple of %d", SizeClassError, size, smallSizeDiv)
+		}
+		// 大于smallSizeMax的按largeSizeDiv查找，不对齐的class永远用不到
+		if size > smallSizeMax && size%largeSizeDiv != 0 {
+			return fmt.Errorf("%w: size(%d) > %d is not a multiple of %d", SizeClassError, size, smallSizeMax, largeSizeDiv)
+		}
+	}
+	if last := sizes[len(sizes)-1]; last != _MaxSmallSize {
+		return fmt.Errorf("%w: the largest size(%d) must be %d", SizeClassError, last, _MaxSmallSize)
+	}
+	return nil
+}
+
+func equalSizes(a, b []uintptr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// makeLookup 生成size到class的查找表，每一格对应能放下该格最大size的最小class
+func (c *sizeClasses) makeLookup() {
+	class := 0
+	for i := range c.size8 {
+		for uintptr(c.size[class]) < uintptr(i)*smallSizeDiv {
+			class++
+		}
+		c.size8[i] = uint8(class)
+	}
+	for i := range c.size128 {
+		for uintptr(c.size[class]) < smallSizeMax+uintptr(i)*largeSizeDiv {
+			class++
+		}
+		c.size128[i] = uint8(class)
+	}
+}
+
+// computeDivMagic 计算 n/size 的乘法魔数(同Go runtime mksizeclasses.go)，
+// 对[0, max]内的n满足 ((n>>shift)*mul)>>shift2 == n/size。
+// mul = ceil(2^k/d)时 n*mul>>k 只会比 n/d 大，误差随n单调增加，余数相同的n中最大的最先出错，
+// 因此只需要校验 (max-d, max] 这d个数，不用遍历[0, max]
+func computeDivMagic(size, max uintptr) (divMagic, error) {
+	var m divMagic
+	d := size
+	if d&(d-1) == 0 {
+		// 2的幂直接移位，baseMask非0作为标记
+		if max >= 1<<16 {
+			return m, fmt.Errorf("%w: max(%d) is too big for size(%d)", SizeClassError, max, size)
+		}
+		m.baseMask = uint16(1<<16 - d)
+	}
+	for d%2 == 0 {
+		m.shift++
+		d >>= 1
+		max >>= 1
+	}
+nextk:
+	for k := uint(0); ; k++ {
+		mul := (uintptr(1)<<k + d - 1) / d
+		lo := uintptr(0)
+		if max >= d {
+			lo = max - d + 1
+		}
+		for n := lo; n <= max; n++ {
+			if n*mul>>k != n/d {
+				continue nextk
+			}
+		}
+		if mul >= 1<<16 {
+			return m, fmt.Errorf("%w: mul(%d) is too big for size(%d)", SizeClassError, mul, size)
+		}
+		if uint64(mul)*uint64(max) >= 1<<32 {
+			return m, fmt.Errorf("%w: mul(%d)*max(%d) is too big for size(%d)", SizeClassError, mul, max, size)
+		}
+		m.mul = uint16(mul)
+		m.shift2 = uint8(k)
+		return m, nil
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"unsafe"
+)
+
+// checkDivMagic 校验span内每个偏移的objIndex
+func checkDivMagic(t *testing.T, c *sizeClasses) {
+	for i := 1; i < c.num(); i++ {
+		size := uintptr(c.size[i])
+		m := c.divmagic[i]
+		s := &xSpan{divShift: m.shift, divMul: m.mul, divShift2: m.shift2, baseMask: m.baseMask}
+		for n := uintptr(0); n < c.spanPages(i)*_PageSize; n++ {
+			if got := s.objIndex(n); got != n/size {
+				t.Fatalf("class %d size %d: objIndex(%d)=%d want %d", i, size, n, got, n/size)
+			}
+		}
+	}
+}
+
+func TestSizeClassesDefault(t *testing.T) {
+	c, err := newSizeClasses(DefaultSizeClasses())
+	if err != nil || c != defaultSizeClasses {
+		t.Fatal(c, err)
+	}
+	checkDivMagic(t, defaultSizeClasses)
+
+	// 从默认大小计算出的查找表应和metadata.go中的一致
+	c = &sizeClasses{size: class_to_size[:]}
+	c.makeLookup()
+	if c.size8 != size_to_class8 || c.size128 != size_to_class128 {
+		t.Fatal("lookup tables are different from default")
+	}
+	// 默认表的divmagic按8K页计算，和重新计算的不一定相同，但都要正确
+	c.npages = class_to_allocnpages[:]
+	c.divmagic = make([]divMagic, _NumSizeClasses)
+	for i := 1; i < _NumSizeClasses; i++ {
+		if c.divmagic[i], err = computeDivMagic(uintptr(c.size[i]), c.spanPages(i)*_PageSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkDivMagic(t, c)
+}
+
+func TestGenerateSizeClasses(t *testing.T) {
+	sizes := GenerateSizeClasses()
+	c, err := newSizeClasses(sizes)
+	if err != nil {
+		t.Fatal(sizes, err)
+	}
+	if c.num() != len(sizes)+1 {
+		t.Fatal("generated sizes are not sorted or unique", sizes)
+	}
+	checkDivMagic(t, c)
+	for i := 1; i < c.num(); i++ {
+		// 尾部浪费不超过1/8
+		span := c.spanPages(i) * _PageSize
+		if tail := span % uintptr(c.size[i]); tail > span/8 {
+			t.Fatalf("class %d size %d tail waste %d", i, c.size[i], tail)
+		}
+	}
+}
+
+func TestSizeClassesIllegal(t *testing.T) {
+	for _, sizes := range [][]uintptr{
+		{8, 20, _MaxSmallSize},
+		{8, 1032, _MaxSmallSize},
+		{8, 16, 1024},
+		{0, _MaxSmallSize},
+		{8, _MaxSmallSize, _MaxSmallSize + 128},
+	} {
+		if _, err := newSizeClasses(sizes); !errors.Is(err, SizeClassError) {
+			t.Fatal(sizes, err)
+		}
+	}
+	var many []uintptr
+	for size := uintptr(8); size <= smallSizeMax; size += 8 {
+		many = append(many, size)
+	}
+	for size := uintptr(smallSizeMax + 128); size <= _MaxSmallSize; size += 128 {
+		many = append(many, size)
+	}
+	if _, err := newSizeClasses(many); !errors.Is(err, SizeClassError) {
+		t.Fatal(len(many), err)
+	}
+	f := &Factory{}
+	if _, err := f.CreateMemoryWithOptions(0.75, Options{SizeClasses: []uintptr{8, 20}}); !errors.Is(err, SizeClassError) {
+		t.Fatal(err)
+	}
+}
+
+func TestCustomSizeClasses(t *testing.T) {
+	f := &Factory{}
+	// 乱序、重复的输入会被排序去重
+	m, err := f.CreateMemoryWithOptions(0.75, Options{SizeClasses: []uintptr{_MaxSmallSize, 72, 40, 8, 40, 4096}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type item struct {
+		a, b uint64
+		c    [3]uint64
+	}
+	if unsafe.Sizeof(item{}) != 40 {
+		t.Fatal(unsafe.Sizeof(item{}))
+	}
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 1000; i++ {
+		p, err := m.Alloc(unsafe.Sizeof(item{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		(*item)(p).a = uint64(i)
+		ptrs = append(ptrs, p)
+	}
+	for _, size := range []uintptr{41, 1000, 5000} {
+		if _, err := m.Alloc(size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var objs int
+	m.Walk(func(obj ObjectInfo) bool {
+		if obj.Size == 40 {
+			objs++
+		}
+		return true
+	})
+	if objs != 1000 {
+		t.Fatal(objs)
+	}
+	for i, p := range ptrs {
+		if (*item)(p).a != uint64(i) {
+			t.Fatal(i)
+		}
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	r := m.FragmentationReport()
+	if len(r.Classes) != 6 || r.Classes[2].ClassSize != 40 || r.Classes[2].Objects != 1000 {
+		t.Fatalf("%+v", r.Classes)
+	}
+	for _, p := range ptrs {
+		if err := m.Free(uintptr(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 快照记录size class表
+	var buf bytes.Buffer
+	if err := m.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, _, err := f.Restore(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.(*mm).h.classes.sizes(); !equalSizes(got, []uintptr{8, 40, 72, 4096, _MaxSmallSize}) {
+		t.Fatal(got)
+	}
+	if err := restored.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bruteDivMagic 逐个校验[0, max]的参考实现
+func bruteDivMagic(size, max uintptr) (mul uintptr, k uint) {
+	d := size
+	for d%2 == 0 {
+		d >>= 1
+		max >>= 1
+	}
+nextk:
+	for k = 0; ; k++ {
+		mul = (uintptr(1)<<k + d - 1) / d
+		for n := uintptr(0); n <= max; n++ {
+			if n*mul>>k != n/d {
+				continue nextk
+			}
+		}
+		return mul, k
+	}
+}
+
+func TestComputeDivMagic(t *testing.T) {
+	for size := uintptr(8); size <= 2048; size += 8 {
+		for _, pages := range []uintptr{classPages(size), classPages(size) * 5} {
+			max := pages * _PageSize
+			m, err := computeDivMagic(size, max)
+			if err != nil {
+				continue
+			}
+			if mul, k := bruteDivMagic(size, max); uintptr(m.mul) != mul || uint(m.shift2) != k {
+				t.Fatalf("size %d max %d: mul %d shift2 %d, want %d %d", size, max, m.mul, m.shift2, mul, k)
+			}
+		}
+	}
+}
+
+func TestConcurrentHashMapSpanPoolClasses(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := newXConcurrentHashMapSpanPool(m.(*mm).h, 0.75, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 默认表中1、2、4、6号class(8、16、48、80字节)
+	want := map[int]uint8{1: 10, 2: 5, 4: 1, 6: 1}
+	for class, c := range sp.specialPageNumCoefficient {
+		if c != want[class] {
+			t.Fatal(class, c, want[class])
+		}
+	}
+}
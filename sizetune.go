@@ -0,0 +1,245 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// sizeBuckets 请求大小按size class的查找粒度统计：<=1024按8字节，>1024按128字节
+const sizeBuckets = smallSizeMax/smallSizeDiv + 1 + (_MaxSmallSize-smallSizeMax)/largeSizeDiv
+
+func sizeBucket(size uintptr) int {
+	if size <= smallSizeMax {
+		return int((size + smallSizeDiv - 1) / smallSizeDiv)
+	}
+	return smallSizeMax/smallSizeDiv + int((size-smallSizeMax+largeSizeDiv-1)/largeSizeDiv)
+}
+
+// bucketSize 桶内最大的请求大小
+func bucketSize(b int) uintptr {
+	if b <= smallSizeMax/smallSizeDiv {
+		return uintptr(b) * smallSizeDiv
+	}
+	return smallSizeMax + uintptr(b-smallSizeMax/smallSizeDiv)*largeSizeDiv
+}
+
+// sizeHistogram Options.SizeSamples开启后统计warm-up期间的请求大小，大对象独占页，不统计
+type sizeHistogram struct {
+	limit  uint64
+	n      uint64
+	counts [sizeBuckets]uint64
+}
+
+func newSizeHistogram(limit int) *sizeHistogram {
+	return &sizeHistogram{limit: uint64(limit)}
+}
+
+func (h *sizeHistogram) add(size uintptr) {
+	if size < 1 || size > _MaxSmallSize || atomic.LoadUint64(&h.n) >= h.limit {
+		return
+	}
+	if atomic.AddUint64(&h.n, 1) > h.limit {
+		return
+	}
+	atomic.AddUint64(&h.counts[sizeBucket(size)], 1)
+}
+
+// SizeCount 一个请求大小(向上取整到查找粒度)的分配次数
+type SizeCount struct {
+	Size  uintptr `json:"size"`
+	Count uint64  `json:"count"`
+}
+
+// SizeProfile warm-up期间采样到的请求大小分布
+type SizeProfile struct {
+	Sizes   []SizeCount    `json:"sizes"`   // 按Size升序
+	Classes SizeClassTable `json:"classes"` // 采样时使用的size class表
+	Done    bool           `json:"done"`    // 是否已经采样满Options.SizeSamples次
+}
+
+// Samples 采样的分配次数
+func (p *SizeProfile) Samples() uint64 {
+	var n uint64
+	for _, sc := range p.Sizes {
+		n += sc.Count
+	}
+	return n
+}
+
+func (m *mm) SizeProfile() *SizeProfile {
+	if m.sizes == nil {
+		return nil
+	}
+	p := &SizeProfile{Classes: m.h.classes.sizes(), Done: atomic.LoadUint64(&m.sizes.n) >= m.sizes.limit}
+	for b := range m.sizes.counts {
+		if n := atomic.LoadUint64(&m.sizes.counts[b]); n > 0 {
+			p.Sizes = append(p.Sizes, SizeCount{Size: bucketSize(b), Count: n})
+		}
+	}
+	return p
+}
+
+// SizeClassTable 可序列化的size class表(文本格式为逗号分隔的大小，可以直接放进json/yaml配置)，
+// 作为Options.SizeClasses使用
+type SizeClassTable []uintptr
+
+func (t SizeClassTable) String() string {
+	b, _ := t.MarshalText()
+	return string(b)
+}
+
+func (t SizeClassTable) MarshalText() ([]byte, error) {
+	var b []byte
+	for i, size := range t {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendUint(b, uint64(size), 10)
+	}
+	return b, nil
+}
+
+func (t *SizeClassTable) UnmarshalText(text []byte) error {
+	var table SizeClassTable
+	for _, field := range strings.Split(string(text), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		size, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return fmt.Errorf("%w: %v", SizeClassError, err)
+		}
+		table = append(table, uintptr(size))
+	}
+	if _, err := newSizeClasses(table); err != nil {
+		return err
+	}
+	*t = table
+	return nil
+}
+
+// SizeClassTuning TuneSizeClasses的结果，字节数均按采样到的分配计算
+type SizeClassTuning struct {
+	Table          SizeClassTable // 调优后的表
+	MaxWaste       float64        // 实际使用的内部碎片上限(class过多时会放宽)
+	Samples        uint64
+	RequestedBytes uint64 // 请求的字节数
+	CurrentBytes   uint64 // 采样时的表占用的字节数
+	TunedBytes     uint64 // 调优后的表占用的字节数
+}
+
+// Saving 预计节省的字节数(按采样数量计)，为负表示调优后更浪费
+func (t *SizeClassTuning) Saving() int64 {
+	return int64(t.CurrentBytes) - int64(t.TunedBytes)
+}
+
+// SavingRatio 预计节省的比例
+func (t *SizeClassTuning) SavingRatio() float64 {
+	if t.CurrentBytes == 0 {
+		return 0
+	}
+	return float64(t.Saving()) / float64(t.CurrentBytes)
+}
+
+func (t *SizeClassTuning) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "size class tuning: %d samples, %d classes, max waste %.1f%%\n", t.Samples, len(t.Table), t.MaxWaste*100)
+	fmt.Fprintf(&b, "\trequested %d bytes, current %d bytes (waste %.1f%%), tuned %d bytes (waste %.1f%%)\n",
+		t.RequestedBytes, t.CurrentBytes, wasteRatio(t.RequestedBytes, t.CurrentBytes),
+		t.TunedBytes, wasteRatio(t.RequestedBytes, t.TunedBytes))
+	fmt.Fprintf(&b, "\texpected saving %d bytes (%.1f%%)\n", t.Saving(), t.SavingRatio()*100)
+	fmt.Fprintf(&b, "\ttable: %s\n", t.Table)
+	return b.String()
+}
+
+func wasteRatio(requested, used uint64) float64 {
+	if used == 0 {
+		return 0
+	}
+	return float64(used-requested) / float64(used) * 100
+}
+
+// TuneSizeClasses 根据采样的请求大小分布生成size class表：从小到大把请求大小分组，
+// 每组的内部碎片(按分配次数加权)不超过maxWaste(如0.1)，每组最大的大小作为一个class。
+// 另外保留2的幂的class，未采样到的大小最多浪费一半
+func TuneSizeClasses(p *SizeProfile, maxWaste float64) (*SizeClassTuning, error) {
+	if p == nil || len(p.Sizes) == 0 {
+		return nil, errors.New("size profile is empty")
+	}
+	if maxWaste < 0 || maxWaste >= 1 {
+		return nil, fmt.Errorf("maxWaste(%v) must be in [0, 1)", maxWaste)
+	}
+	current, err := newSizeClasses(p.Classes)
+	if err != nil {
+		return nil, err
+	}
+	t := &SizeClassTuning{MaxWaste: maxWaste}
+	for {
+		t.Table = groupSizes(p.Sizes, t.MaxWaste)
+		if len(t.Table) < maxNumSizeClasses {
+			break
+		}
+		// class太多时放宽上限
+		t.MaxWaste = t.MaxWaste*2 + 0.01
+	}
+	tuned, err := newSizeClasses(t.Table)
+	if err != nil {
+		return nil, err
+	}
+	for _, sc := range p.Sizes {
+		t.Samples += sc.Count
+		t.RequestedBytes += uint64(sc.Size) * sc.Count
+		t.CurrentBytes += uint64(current.size[current.sizeToClass(sc.Size)]) * sc.Count
+		t.TunedBytes += uint64(tuned.size[tuned.sizeToClass(sc.Size)]) * sc.Count
+	}
+	return t, nil
+}
+
+// groupSizes 贪心分组，返回排序去重后的class大小
+func groupSizes(sizes []SizeCount, maxWaste float64) SizeClassTable {
+	classes := make(map[uintptr]bool)
+	for size := uintptr(smallSizeDiv); size <= _MaxSmallSize; size *= 2 {
+		classes[size] = true
+	}
+	for i := 0; i < len(sizes); {
+		var requested, n uint64
+		j := i
+		for ; j < len(sizes); j++ {
+			r, c := requested+uint64(sizes[j].Size)*sizes[j].Count, n+sizes[j].Count
+			if j > i && float64(uint64(sizes[j].Size)*c-r) > maxWaste*float64(uint64(sizes[j].Size)*c) {
+				break
+			}
+			requested, n = r, c
+		}
+		classes[sizes[j-1].Size] = true
+		i = j
+	}
+	var table SizeClassTable
+	for size := uintptr(smallSizeDiv); size <= _MaxSmallSize; size += smallSizeDiv {
+		if classes[size] {
+			table = append(table, size)
+		}
+	}
+	return table
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTuneSizeClasses(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemoryWithOptions(0.75, Options{SizeSamples: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := m.Alloc(20); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.From(strings.Repeat("x", 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := m.SizeProfile()
+	if p.Done || p.Samples() != 2000 {
+		t.Fatal(p.Done, p.Samples())
+	}
+	for i := 0; i < 2000; i++ {
+		if _, err := m.Alloc(1100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// warm-up结束后不再记录
+	p = m.SizeProfile()
+	if !p.Done || p.Samples() != 3000 {
+		t.Fatal(p.Done, p.Samples())
+	}
+	want := []SizeCount{{24, 1000}, {104, 1000}, {1152, 1000}}
+	if len(p.Sizes) != len(want) {
+		t.Fatal(p.Sizes)
+	}
+	for i := range want {
+		if p.Sizes[i] != want[i] {
+			t.Fatal(p.Sizes)
+		}
+	}
+
+	tuning, err := TuneSizeClasses(p, 0.05)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(tuning)
+	for _, size := range []uintptr{24, 104, 1152} {
+		found := false
+		for _, c := range tuning.Table {
+			found = found || c == size
+		}
+		if !found {
+			t.Fatal(size, tuning.Table)
+		}
+	}
+	if tuning.RequestedBytes != 24000+104000+1152000 || tuning.TunedBytes != tuning.RequestedBytes ||
+		tuning.Saving() <= 0 || tuning.CurrentBytes-tuning.TunedBytes != uint64(tuning.Saving()) {
+		t.Fatalf("%+v", tuning)
+	}
+
+	// 表可以通过配置文件下发给下一个实例
+	conf, err := json.Marshal(struct{ Classes SizeClassTable }{tuning.Table})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded struct{ Classes SizeClassTable }
+	if err := json.Unmarshal(conf, &loaded); err != nil {
+		t.Fatal(string(conf), err)
+	}
+	if !equalSizes(loaded.Classes, tuning.Table) {
+		t.Fatal(loaded.Classes, tuning.Table)
+	}
+	next, err := f.CreateMemoryWithOptions(0.75, Options{SizeClasses: loaded.Classes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := next.Alloc(1100); err != nil {
+		t.Fatal(err)
+	}
+	if r := next.FragmentationReport(); r.Classes[next.(*mm).h.classes.sizeToClass(1100)].ClassSize != 1152 {
+		t.Fatal(r)
+	}
+}
+
+func TestTuneSizeClassesGroup(t *testing.T) {
+	var sizes []SizeCount
+	for size := uintptr(8); size <= 512; size += 8 {
+		sizes = append(sizes, SizeCount{Size: size, Count: 10})
+	}
+	p := &SizeProfile{Sizes: sizes}
+	loose, err := TuneSizeClasses(p, 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tight, err := TuneSizeClasses(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loose.Table) >= len(tight.Table) || tight.TunedBytes != tight.RequestedBytes || loose.TunedBytes <= tight.TunedBytes {
+		t.Fatal(loose, tight)
+	}
+	if _, err := TuneSizeClasses(&SizeProfile{}, 0.1); err == nil {
+		t.Fatal("empty profile")
+	}
+	if _, err := TuneSizeClasses(p, 1); err == nil {
+		t.Fatal("maxWaste is 1")
+	}
+}
+
+func TestSizeClassTableText(t *testing.T) {
+	var table SizeClassTable
+	if err := table.UnmarshalText([]byte("8, 40,72,32768")); err != nil {
+		t.Fatal(err)
+	}
+	if table.String() != "8,40,72,32768" {
+		t.Fatal(table)
+	}
+	if err := table.UnmarshalText([]byte("8,abc,32768")); !errors.Is(err, SizeClassError) {
+		t.Fatal(err)
+	}
+	if err := table.UnmarshalText([]byte("8,20,32768")); !errors.Is(err, SizeClassError) {
+		t.Fatal(err)
+	}
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SizeProfile() != nil {
+		t.Fatal("SizeSamples is off")
+	}
+}
@@ -0,0 +1,502 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"unsafe"
+)
+
+// 快照格式(小端):
+//
+//	header:  magic(8) version(u32) pageSize(u32) spanFact(f32) base(u64) totalCapacity(i64) freeCapacity(i64)
+//	classes: count(u32) { size(u32) }                         不包括0号的size class表(version 2)
+//	arenas:  count(u32) { l2Index(u64) }                      addrMap中已使用的RawMemory
+//	spans:   count(u32) { kind(u8) classIndex(u32) classSize startAddr npages freeIndex nelems allocCount
+//	                      extensionPoint allocCache(u64...) bitsLen(u32) allocBits gcmarkBits pages }
+//	chunks:  count(u32) { startAddr(u64) npages(u64) }        空闲页(treap)
+const (
+	snapshotMagic   = "XMMSNAP\x00"
+	snapshotVersion = 2
+)
+
+var SnapshotFormatError = errors.New("snapshot format is illegal")
+
+// AddrRange 地址区间映射 [Old, Old+Size) -> [New, New+Size)
+type AddrRange struct {
+	Old  uintptr
+	New  uintptr
+	Size uintptr
+}
+
+// Relocation 快照恢复后的地址转换表。恢复到原地址时Old == New。
+type Relocation struct {
+	Ranges []AddrRange
+}
+
+// Translate 将快照中的地址转换为恢复后堆中的地址
+func (r *Relocation) Translate(old uintptr) (uintptr, bool) {
+	for _, ar := range r.Ranges {
+		if old >= ar.Old && old < ar.Old+ar.Size {
+			return old - ar.Old + ar.New, true
+		}
+	}
+	return 0, false
+}
+
+// Relocated 是否恢复到了不同的地址
+func (r *Relocation) Relocated() bool {
+	for _, ar := range r.Ranges {
+		if ar.Old != ar.New {
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshot 将堆(使用中的RawMemory、span元数据、空闲页treap、addrMap布局)序列化到w。
+// 调用方需要暂停堆：快照期间不能有并发的Alloc/Free，否则快照不一致。
+func (m *mm) Snapshot(w io.Writer) error {
+	sp, ok := m.sp.(*xSpanPool)
+	if !ok {
+		return errors.New("spanPool is not support snapshot")
+	}
+	h := m.h
+	if h.opts.GuardPages {
+		// 保护页不可读
+		return errors.New("snapshot is not supported in GuardPages mode")
+	}
+	for i := range sp.lock {
+		sp.lock[i].Lock()
+		defer sp.lock[i].Unlock()
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	sw := &snapshotWriter{w: bufio.NewWriterSize(w, 1<<20)}
+	sw.bytes([]byte(snapshotMagic))
+	sw.u32(snapshotVersion)
+	sw.u32(_PageSize)
+	sw.u32(math.Float32bits(sp.spanFact))
+	sw.u64(uint64(h.base))
+	sw.u64(uint64(h.totalCapacity))
+	sw.u64(uint64(h.freeCapacity))
+
+	sizes := h.classes.sizes()
+	sw.u32(uint32(len(sizes)))
+	for _, size := range sizes {
+		sw.u32(uint32(size))
+	}
+
+	arenas := h.arenas()
+	sw.u32(uint32(len(arenas)))
+	for _, ai := range arenas {
+		sw.u64(uint64(ai))
+	}
+
+	var spans []*xSpan
+	var kinds []spanKind
+	if err := sp.foreachSpan(func(span *xSpan, kind spanKind) error {
+		spans, kinds = append(spans, span), append(kinds, kind)
+		return nil
+	}); err != nil {
+		return err
+	}
+	sw.u32(uint32(len(spans)))
+	for i, span := range spans {
+		sw.span(span, kinds[i])
+	}
+
+	var chunks []*xChunk
+	h.freeChunks.treap.walkTreap(func(tn *treapNode) {
+		chunks = append(chunks, tn.chunk)
+	})
+	sw.u32(uint32(len(chunks)))
+	for _, chunk := range chunks {
+		sw.u64(uint64(chunk.startAddr))
+		sw.u64(uint64(chunk.npages))
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+// Restore 从Snapshot的输出中恢复出一个新的XMemory，使用默认的Options(快照中只保存size class表)。
+// 优先恢复到快照时的地址，地址被占用时整体搬迁到新的地址，返回的Relocation记录地址转换关系；
+// 搬迁后XMM内存中保存的裸地址需要调用方通过Relocation转换，RelPtr不受影响。
+func (s *Factory) Restore(r io.Reader) (XMemory, *Relocation, error) {
+	return s.RestoreWithOptions(r, Options{})
+}
+
+// RestoreWithOptions 同Restore，恢复出的堆使用opts。opts.SizeClasses为nil时使用快照中的表，否则必须和快照一致；
+// 快照中的对象没有canary和保护页，不支持Poison和GuardPages；TrackSizes时恢复出的对象按请求大小等于slot大小统计
+func (s *Factory) RestoreWithOptions(r io.Reader, opts Options) (XMemory, *Relocation, error) {
+	if opts.Poison || opts.GuardPages {
+		return nil, nil, errors.New("Poison and GuardPages are not supported by Restore")
+	}
+	sr := &snapshotReader{r: bufio.NewReaderSize(r, 1<<20)}
+	magic := make([]byte, len(snapshotMagic))
+	sr.bytes(magic)
+	if sr.err != nil {
+		return nil, nil, sr.err
+	}
+	if string(magic) != snapshotMagic {
+		return nil, nil, SnapshotFormatError
+	}
+	version := sr.u32()
+	if version < 1 || version > snapshotVersion {
+		return nil, nil, fmt.Errorf("%w: version(%d) is not support", SnapshotFormatError, version)
+	}
+	if pageSize := sr.u32(); pageSize != _PageSize {
+		return nil, nil, fmt.Errorf("%w: pageSize(%d) is not support", SnapshotFormatError, pageSize)
+	}
+	spanFact := math.Float32frombits(sr.u32())
+	base := uintptr(sr.u64())
+	totalCapacity, freeCapacity := int64(sr.u64()), int64(sr.u64())
+	// version 1 没有记录size class表，使用默认表
+	var sizes []uintptr
+	if version >= 2 {
+		classNum := sr.u32()
+		if classNum >= maxNumSizeClasses {
+			return nil, nil, fmt.Errorf("%w: too many size classes(%d)", SnapshotFormatError, classNum)
+		}
+		for i := uint32(0); i < classNum && sr.err == nil; i++ {
+			sizes = append(sizes, uintptr(sr.u32()))
+		}
+	}
+	arenaNum := sr.u32()
+	if sr.err != nil {
+		return nil, nil, sr.err
+	}
+	if arenaNum < 1 {
+		return nil, nil, fmt.Errorf("%w: no arena", SnapshotFormatError)
+	}
+	arenas := make([]RawMemoryIdx, arenaNum)
+	for i := range arenas {
+		arenas[i] = RawMemoryIdx(sr.u64())
+		if i > 0 && arenas[i] <= arenas[i-1] {
+			return nil, nil, fmt.Errorf("%w: arenas is not sorted", SnapshotFormatError)
+		}
+	}
+	if sr.err != nil {
+		return nil, nil, sr.err
+	}
+
+	if opts.SizeClasses != nil {
+		classes, err := newSizeClasses(opts.SizeClasses)
+		if err != nil {
+			return nil, nil, err
+		}
+		want := sizes
+		if want == nil {
+			// version 1 的快照使用默认表
+			want = defaultSizeClasses.sizes()
+		}
+		if !equalSizes(classes.sizes(), want) {
+			return nil, nil, errors.New("opts.SizeClasses is different from the snapshot")
+		}
+	}
+	opts.SizeClasses = sizes
+	h, err := newEmptyXHeap(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sizes != nil && !equalSizes(h.classes.sizes(), sizes) {
+		return nil, nil, fmt.Errorf("%w: size classes are not sorted", SnapshotFormatError)
+	}
+	reloc, err := h.mapArenas(arenas)
+	if err != nil {
+		return nil, nil, err
+	}
+	translate := func(addr uintptr) (uintptr, error) {
+		if newAddr, ok := reloc.Translate(addr); ok {
+			return newAddr, nil
+		}
+		return 0, fmt.Errorf("%w: addr(%d) is not in arenas", SnapshotFormatError, addr)
+	}
+	if h.base, err = translate(base); err != nil {
+		return nil, nil, err
+	}
+	h.totalCapacity, h.freeCapacity = totalCapacity, freeCapacity
+	sp, err := newXSpanPool(h, spanFact)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	spanNum := sr.u32()
+	for i := uint32(0); i < spanNum && sr.err == nil; i++ {
+		if err := sr.span(h, sp, translate); err != nil {
+			return nil, nil, err
+		}
+	}
+	chunkNum := sr.u32()
+	for i := uint32(0); i < chunkNum && sr.err == nil; i++ {
+		startAddr, npages := uintptr(sr.u64()), uintptr(sr.u64())
+		if sr.err != nil {
+			break
+		}
+		if startAddr, err = translate(startAddr); err != nil {
+			return nil, nil, err
+		}
+		chunkP, err := h.chunkAllocator.alloc()
+		if err != nil {
+			return nil, nil, err
+		}
+		chunk := (*xChunk)(chunkP)
+		chunk.startAddr, chunk.npages = startAddr, npages
+		if err := h.freeChunks.insert(chunk); err != nil {
+			return nil, nil, err
+		}
+	}
+	if sr.err != nil {
+		return nil, nil, sr.err
+	}
+	s.sp = sp
+	return newMM(sp, h, opts), reloc, nil
+}
+
+// arenas 返回addrMap中已使用的RawMemory索引(升序)
+func (xh *xHeap) arenas() []RawMemoryIdx {
+	var arenas []RawMemoryIdx
+	for l1, l2s := range xh.addrMap {
+		if l2s == nil {
+			continue
+		}
+		for l2, rlm := range l2s {
+			if rlm != nil {
+				arenas = append(arenas, RawMemoryIdx(uint(l1)<<RawMemoryL1Shift|uint(l2)))
+			}
+		}
+	}
+	return arenas
+}
+
+// mapArenas 一次性预留能覆盖所有arena的连续地址空间(保持arena之间的相对位置，RelPtr依然有效)，
+// 优先使用原地址，然后映射各个arena并初始化addrMap
+func (xh *xHeap) mapArenas(arenas []RawMemoryIdx) (*Relocation, error) {
+	oldStart := RawMemoryBase(arenas[0])
+	size := RawMemoryBase(arenas[len(arenas)-1]) + heapRawMemoryBytes - oldStart
+	la := &xh.rawLinearMemoryAlloc
+	p, reserved, err := la.sysReserveAligned(unsafe.Pointer(oldStart), size, heapRawMemoryBytes)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, errors.New("reserve arenas failed")
+	}
+	newStart := uintptr(p)
+	la.next, la.mapped, la.end = newStart+size, newStart+size, newStart+reserved
+	reloc := &Relocation{}
+	for _, ai := range arenas {
+		oldAddr := RawMemoryBase(ai)
+		newAddr := oldAddr - oldStart + newStart
+		if err := la.sysMap(unsafe.Pointer(newAddr), heapRawMemoryBytes); err != nil {
+			return nil, err
+		}
+		rawLinearMemoryPtr, err := xh.rawLinearMemoryAllocator.alloc()
+		if err != nil {
+			return nil, err
+		}
+		index := RawMemoryIndex(newAddr)
+		if addrs := xh.addrMap[index.l1()]; addrs == nil {
+			var a [1 << RawMemoryL2Bits]*xRawLinearMemory
+			xh.addrMap[index.l1()] = &a
+		}
+		xh.addrMap[index.l1()][index.l2()] = (*xRawLinearMemory)(rawLinearMemoryPtr)
+		reloc.Ranges = append(reloc.Ranges, AddrRange{Old: oldAddr, New: newAddr, Size: heapRawMemoryBytes})
+	}
+	return reloc, nil
+}
+
+// bitsLen span的allocBits/gcmarkBits字节数，和newMarkBits保持一致
+func (s *xSpan) bitsLen() uintptr {
+	if s.allocBits == nil || s.gcmarkBits == nil {
+		return 0
+	}
+	blocksNeeded := (s.nelems + 63) / 64
+	if blocksNeeded < 1 {
+		blocksNeeded = 1
+	}
+	return blocksNeeded * 8
+}
+
+func rawBytes(addr, size uintptr) []byte {
+	return *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{Data: addr, Len: int(size), Cap: int(size)}))
+}
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf [8]byte
+	err error
+}
+
+func (sw *snapshotWriter) bytes(b []byte) {
+	if sw.err != nil {
+		return
+	}
+	_, sw.err = sw.w.Write(b)
+}
+
+func (sw *snapshotWriter) u8(v uint8) {
+	sw.buf[0] = v
+	sw.bytes(sw.buf[:1])
+}
+
+func (sw *snapshotWriter) u32(v uint32) {
+	binary.LittleEndian.PutUint32(sw.buf[:4], v)
+	sw.bytes(sw.buf[:4])
+}
+
+func (sw *snapshotWriter) u64(v uint64) {
+	binary.LittleEndian.PutUint64(sw.buf[:8], v)
+	sw.bytes(sw.buf[:8])
+}
+
+func (sw *snapshotWriter) span(span *xSpan, kind spanKind) {
+	sw.u8(uint8(kind))
+	sw.u32(uint32(span.classIndex))
+	sw.u64(uint64(span.classSize))
+	sw.u64(uint64(span.startAddr))
+	sw.u64(uint64(span.npages))
+	sw.u64(uint64(span.freeIndex))
+	sw.u64(uint64(span.nelems))
+	sw.u64(uint64(span.allocCount))
+	sw.u64(uint64(span.extensionPoint))
+	sw.u64(span.allocCache)
+	bitsLen := span.bitsLen()
+	sw.u32(uint32(bitsLen))
+	if bitsLen > 0 {
+		sw.bytes(rawBytes(uintptr(unsafe.Pointer(span.allocBits)), bitsLen))
+		sw.bytes(rawBytes(uintptr(unsafe.Pointer(span.gcmarkBits)), bitsLen))
+	}
+	sw.bytes(rawBytes(span.startAddr, span.npages*_PageSize))
+}
+
+type snapshotReader struct {
+	r   *bufio.Reader
+	buf [8]byte
+	err error
+}
+
+func (sr *snapshotReader) bytes(b []byte) {
+	if sr.err != nil {
+		return
+	}
+	_, sr.err = io.ReadFull(sr.r, b)
+}
+
+func (sr *snapshotReader) u8() uint8 {
+	sr.bytes(sr.buf[:1])
+	return sr.buf[0]
+}
+
+func (sr *snapshotReader) u32() uint32 {
+	sr.bytes(sr.buf[:4])
+	return binary.LittleEndian.Uint32(sr.buf[:4])
+}
+
+func (sr *snapshotReader) u64() uint64 {
+	sr.bytes(sr.buf[:8])
+	return binary.LittleEndian.Uint64(sr.buf[:8])
+}
+
+// span 读取一个span，恢复元数据、bitmap、页内容以及所在的链表
+func (sr *snapshotReader) span(h *xHeap, sp *xSpanPool, translate func(uintptr) (uintptr, error)) error {
+	kind := spanKind(sr.u8())
+	classIndex := uint(sr.u32())
+	classSize := uintptr(sr.u64())
+	startAddr := uintptr(sr.u64())
+	npages := uintptr(sr.u64())
+	freeIndex, nelems, allocCount := uintptr(sr.u64()), uintptr(sr.u64()), uintptr(sr.u64())
+	extensionPoint, allocCache := uintptr(sr.u64()), sr.u64()
+	bitsLen := uintptr(sr.u32())
+	if sr.err != nil {
+		return sr.err
+	}
+	if int(classIndex) >= h.classes.num() || kind > spanRaw || npages < 1 {
+		return fmt.Errorf("%w: span class(%d) kind(%d) npages(%d)", SnapshotFormatError, classIndex, kind, npages)
+	}
+	if _, err := translate(startAddr + npages*_PageSize - 1); err != nil {
+		return err
+	}
+	startAddr, err := translate(startAddr)
+	if err != nil {
+		return err
+	}
+	chunkP, err := h.spanAllocator.alloc()
+	if err != nil {
+		return err
+	}
+	span := (*xSpan)(chunkP)
+	span.classIndex, span.classSize = classIndex, classSize
+	span.startAddr, span.npages = startAddr, npages
+	span.freeIndex, span.nelems, span.allocCount = freeIndex, nelems, allocCount
+	span.extensionPoint, span.allocCache = extensionPoint, allocCache
+	span.heap = h
+	if h.opts.TrackSizes {
+		if span.reqWaste, err = newWasteTable(nelems); err != nil {
+			return err
+		}
+	}
+	if classIndex > 0 {
+		m, err := h.classes.spanDivMagic(int(classIndex), npages)
+		if err != nil {
+			return err
+		}
+		span.divShift, span.divMul, span.divShift2, span.baseMask = m.shift, m.mul, m.shift2, m.baseMask
+	}
+	if bitsLen > 0 {
+		if span.allocBits, err = newMarkBits(nelems, true); err != nil {
+			return err
+		}
+		if span.gcmarkBits, err = newMarkBits(nelems, true); err != nil {
+			return err
+		}
+		if bitsLen != span.bitsLen() {
+			return fmt.Errorf("%w: span bitsLen(%d) nelems(%d)", SnapshotFormatError, bitsLen, nelems)
+		}
+		sr.bytes(rawBytes(uintptr(unsafe.Pointer(span.allocBits)), bitsLen))
+		sr.bytes(rawBytes(uintptr(unsafe.Pointer(span.gcmarkBits)), bitsLen))
+	}
+	sr.bytes(rawBytes(startAddr, npages*_PageSize))
+	if sr.err != nil {
+		return sr.err
+	}
+	h.setSpans(startAddr, npages, span)
+	switch kind {
+	case spanInUse:
+		spans, _ := sp.getSpan(uint8(classIndex))
+		newSpans := append(append([]*xSpan{}, spans...), span)
+		sp.spans[classIndex] = &newSpans
+	case spanFree:
+		h.classSpan[classIndex].free.insert(span)
+	case spanFull:
+		h.classSpan[classIndex].full.insert(span)
+	case spanRaw:
+		h.rawSpans.insert(span)
+	}
+	return nil
+}
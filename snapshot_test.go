@@ -0,0 +1,196 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	f := &Factory{}
+	mm, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []uintptr
+	var head RelPtr
+	for i := 0; i < 5000; i++ {
+		p, err := mm.Alloc(unsafe.Sizeof(relNode{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := (*relNode)(p)
+		node.Val, node.Next = i, head
+		if err := head.From(mm, p); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, uintptr(p))
+	}
+	var strs []string
+	for i := 0; i < 1000; i++ {
+		s, err := mm.From(fmt.Sprintf("snapshot_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		strs = append(strs, s)
+	}
+	big, err := mm.Alloc(_MaxSmallSize * 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(rawBytes(uintptr(big), 8), "bigbig!!")
+	raw, err := mm.RawAlloc(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(rawBytes(raw.StartAddr, 8), "rawraw!!")
+
+	var buf bytes.Buffer
+	if err := mm.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, reloc, err := f.Restore(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 原堆仍然占用原地址，必然发生搬迁
+	if !reloc.Relocated() {
+		t.Fatal("expect relocated")
+	}
+	for i, u := range users {
+		addr, ok := reloc.Translate(u)
+		if !ok {
+			t.Fatal(i, u)
+		}
+		if node := (*relNode)(unsafe.Pointer(addr)); node.Val != i {
+			t.Fatal(i, node.Val)
+		}
+	}
+	cnt := len(users) - 1
+	for r := head; !r.IsNil(); cnt-- {
+		p, err := r.Resolve(restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := (*relNode)(p)
+		if node.Val != cnt {
+			t.Fatal(node.Val, cnt)
+		}
+		r = node.Next
+	}
+	for i, s := range strs {
+		addr, _ := reloc.Translate((*reflect.StringHeader)(unsafe.Pointer(&s)).Data)
+		if got := string(rawBytes(addr, uintptr(len(s)))); got != fmt.Sprintf("snapshot_%d", i) {
+			t.Fatal(i, got)
+		}
+	}
+	if addr, _ := reloc.Translate(uintptr(big)); string(rawBytes(addr, 8)) != "bigbig!!" {
+		t.Fatal("big object lost")
+	}
+	if addr, _ := reloc.Translate(raw.StartAddr); string(rawBytes(addr, 8)) != "rawraw!!" {
+		t.Fatal("raw chunk lost")
+	}
+
+	// 恢复后的堆可以继续分配、释放，并且不会覆盖已有对象
+	for i := 0; i < 5000; i++ {
+		p, err := restored.Alloc(unsafe.Sizeof(relNode{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		(*relNode)(p).Val = -1
+	}
+	if _, err := restored.Alloc(_MaxSmallSize * 2); err != nil {
+		t.Fatal(err)
+	}
+	for i, u := range users {
+		addr, _ := reloc.Translate(u)
+		if node := (*relNode)(unsafe.Pointer(addr)); node.Val != i {
+			t.Fatal(i, node.Val)
+		}
+		if i%2 == 0 {
+			if err := restored.Free(addr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestRestoreIllegal(t *testing.T) {
+	f := &Factory{}
+	if _, _, err := f.Restore(bytes.NewReader([]byte("XMMSNAP\x00\x09\x00\x00\x00"))); err == nil {
+		t.Fatal("expect version err")
+	}
+	if _, _, err := f.Restore(bytes.NewReader([]byte("hello world"))); err == nil {
+		t.Fatal("expect magic err")
+	}
+}
+
+func TestRestoreWithOptions(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := m.Alloc(40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := m.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap := buf.Bytes()
+	if _, _, err := f.RestoreWithOptions(bytes.NewReader(snap), Options{Poison: true}); err == nil {
+		t.Fatal("Poison is not supported")
+	}
+	if _, _, err := f.RestoreWithOptions(bytes.NewReader(snap), Options{SizeClasses: DefaultSizeClasses()}); err != nil {
+		t.Fatal(err)
+	}
+	def := DefaultSizeClasses()
+	custom := append(append(append([]uintptr(nil), def[:2]...), 24), def[2:]...)
+	if _, _, err := f.RestoreWithOptions(bytes.NewReader(snap), Options{SizeClasses: custom}); err == nil {
+		t.Fatal("size classes are different")
+	}
+
+	restored, reloc, err := f.RestoreWithOptions(bytes.NewReader(snap), Options{TrackLeaks: true, TrackSizes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Alloc(40); err != nil {
+		t.Fatal(err)
+	}
+	// 只记录恢复之后的分配
+	if leaks := restored.LeakReport(); len(leaks) != 1 || leaks.Bytes() != 40 {
+		t.Fatal(leaks)
+	}
+	addr, ok := reloc.Translate(uintptr(old))
+	if !ok {
+		t.Fatal("translate")
+	}
+	if err := restored.Free(addr); err != nil {
+		t.Fatal(err)
+	}
+	if restored.FragmentationReport() == nil {
+		t.Fatal("fragmentation report")
+	}
+}
@@ -55,6 +55,10 @@ type xSpan struct {
 
 	allocCount uintptr
 
+	guarded bool // 保护页模式分配的span，见guard.go
+
+	reqWaste *uint16 // Options.TrackSizes时每个slot的 slot大小-请求大小，见fragmentation.go
+
 	next *xSpan
 	// pre  *xSpan
 	heap *xHeap
@@ -84,13 +88,24 @@ func (s *xSpan) Init(fact float32, heap *xHeap) error {
 		return err
 	}
 	s.allocBits, err = newAllocBits(s.nelems)
+	if err != nil {
+		return err
+	}
+	if heap != nil && heap.opts.TrackSizes && s.reqWaste == nil {
+		if s.reqWaste, err = newWasteTable(s.nelems); err != nil {
+			return err
+		}
+	}
 	if index := s.classIndex; index == 0 {
 		s.divShift = 0
 		s.divMul = 0
 		s.divShift2 = 0
 		s.baseMask = 0
 	} else {
-		m := &class_to_divmagic[index]
+		m, err := s.heap.classes.spanDivMagic(int(index), s.npages)
+		if err != nil {
+			return err
+		}
 		s.divShift = m.shift
 		s.divMul = m.mul
 		s.divShift2 = m.shift2
@@ -210,6 +225,22 @@ func (s *xSpan) nextFree() (v uintptr, has bool) {
 	return
 }
 
+// nextFreeN 一次加锁从span中取出最多len(out)个空闲slot，返回取出的个数
+func (s *xSpan) nextFreeN(out []unsafe.Pointer) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for ; n < len(out); n++ {
+		offset, has := s.nextFreeIndex()
+		if !has {
+			break
+		}
+		s.allocCount++
+		out[n] = unsafe.Pointer(offset*s.classSize + s.base())
+	}
+	return n
+}
+
 // 当前allocCache没该内容
 func (s *xSpan) nextFreeIndex() (uintptr, bool) {
 	sfreeindex := s.freeIndex
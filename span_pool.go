@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -37,18 +38,21 @@ const (
 )
 
 type xSpanPool struct {
-	lock                      [_NumSizeClasses]*sync.RWMutex
-	inuse                     [_NumSizeClasses]uint64
+	lock                      []*sync.RWMutex
+	inuse                     []uint64
 	debug                     bool
-	spanGen                   [_NumSizeClasses]int32     // 小于0 正在扩容
-	spans                     [_NumSizeClasses]*[]*xSpan // 预分配,spans很短，不存在引用超长，第一个为当前正在使用的，第二个为预先分配的span
+	spanGen                   []int32     // 小于0 正在扩容
+	spans                     []*[]*xSpan // 预分配,spans很短，不存在引用超长，第一个为当前正在使用的，第二个为预先分配的span
 	heap                      *xHeap
 	spanFact                  float32
-	specialPageNumCoefficient [_NumSizeClasses]uint8
+	specialPageNumCoefficient []uint8
 	// 1750 + 950
-	classSpan [_NumSizeClasses]*xClassSpan
+	classSpan []*xClassSpan
+	released  int32 // 不为0时已经release，不能再扩容
 }
 
+var SpanPoolReleasedError = errors.New("span pool is released")
+
 func newXSpanPool(heap *xHeap, spanFact float32) (*xSpanPool, error) {
 	sp := &xSpanPool{heap: heap, spanFact: spanFact, classSpan: heap.classSpan}
 	if err := sp.initLock(); err != nil {
@@ -57,8 +61,15 @@ func newXSpanPool(heap *xHeap, spanFact float32) (*xSpanPool, error) {
 	return sp, nil
 }
 
+// initLock 按堆的class个数初始化各class的状态
 func (sp *xSpanPool) initLock() error {
-	for i := 0; i < _NumSizeClasses; i++ {
+	n := len(sp.classSpan)
+	sp.lock = make([]*sync.RWMutex, n)
+	sp.inuse = make([]uint64, n)
+	sp.spanGen = make([]int32, n)
+	sp.spans = make([]*[]*xSpan, n)
+	sp.specialPageNumCoefficient = make([]uint8, n)
+	for i := 0; i < n; i++ {
 		var l sync.RWMutex
 		sp.lock[i] = &l
 	}
@@ -66,9 +77,13 @@ func (sp *xSpanPool) initLock() error {
 }
 
 func (sp *xSpanPool) allocClassSpan(index int) (ptr *xSpan, err error) {
-	pageNum := class_to_allocnpages[index]
-	size := class_to_size[index]
-	pageNum = uint8(Align(Align(uintptr(size), _PageSize)/uintptr(_PageSize), uintptr(pageNum)))
+	if coefficient := sp.specialPageNumCoefficient[index]; coefficient > 1 {
+		// 高频的小对象使用coefficient倍页数的span，减少扩容次数；span太大divMagic算不出来时用默认页数
+		pageNum := sp.heap.classes.spanPages(index) * uintptr(coefficient)
+		if _, err := sp.heap.classes.spanDivMagic(index, pageNum); err == nil {
+			return sp.classSpan[index].allocSpanPages(0.75, pageNum)
+		}
+	}
 	span, err := sp.classSpan[index].allocSpan(index, 0.75)
 	if err != nil {
 		return nil, err
@@ -106,9 +121,22 @@ func (sp *xSpanPool) AllocSlice(eleSize uintptr, cap, len uintptr) (p unsafe.Poi
 
 var is bool
 
+func (sp *xSpanPool) Alloc(size uintptr) (p unsafe.Pointer, err error) {
+	if p, err = sp.alloc(size); err != nil || sp.heap.debug == nil {
+		return p, err
+	}
+	if span, err := sp.heap.spanOf(uintptr(p)); err == nil && span != nil {
+		sp.heap.debug.onAlloc(span, uintptr(p), size)
+	}
+	return p, nil
+}
+
 // 通过增加key、value长度使得分配到不同span
 // todo 擦除数据
-func (sp *xSpanPool) Alloc(size uintptr) (p unsafe.Pointer, err error) {
+func (sp *xSpanPool) alloc(size uintptr) (p unsafe.Pointer, err error) {
+	if sp.needGuard(size) {
+		return sp.allocGuarded(size)
+	}
 	if size > _MaxSmallSize {
 		pageNum := Align(size, _PageSize) / _PageSize
 		chunk, err := sp.heap.allocRawSpan(pageNum)
@@ -120,16 +148,15 @@ func (sp *xSpanPool) Alloc(size uintptr) (p unsafe.Pointer, err error) {
 		}
 		chunk.allocCount = 1
 		chunk.nelems = 1
+		if chunk.reqWaste != nil {
+			chunk.setWaste(0, pageNum*_PageSize-size)
+		}
 		sp.classSpan[0].releaseSpan(chunk)
 		return unsafe.Pointer(chunk.startAddr), nil
 	}
-	var sizeclass uint8
-	if size <= smallSizeMax-8 {
-		sizeclass = size_to_class8[(size+smallSizeDiv-1)/smallSizeDiv]
-	} else {
-		sizeclass = size_to_class128[(size-smallSizeMax+largeSizeDiv-1)/largeSizeDiv]
-	}
-	size = uintptr(class_to_size[sizeclass])
+	reqSize := size
+	sizeclass := sp.heap.classes.sizeToClass(size)
+	size = uintptr(sp.heap.classes.size[sizeclass])
 	spans, spanGen := sp.getSpan(sizeclass)
 	var ptr, idex uintptr
 	var has, needGrow bool
@@ -141,6 +168,9 @@ func (sp *xSpanPool) Alloc(size uintptr) (p unsafe.Pointer, err error) {
 			if err := sp.clear(ptr, size); err != nil {
 				log.Printf("xSpanPool.Alloc clear err:%s", err)
 			}
+			if span.reqWaste != nil {
+				span.setWaste(span.objIndex(ptr), size-reqSize)
+			}
 			needGrow = span.needGrow()
 			idex = uintptr(i)
 			break
@@ -167,11 +197,125 @@ func (sp *xSpanPool) Alloc(size uintptr) (p unsafe.Pointer, err error) {
 		if err := sp.growSpan(sizeclass, ExpendSync, spanGen); err != nil {
 			return nil, err
 		}
-		return sp.Alloc(size)
+		return sp.alloc(reqSize)
 	}
 	return nil, fmt.Errorf("idex:%d has:%t is err", idex, has)
 }
 
+// zeroBuf 批量分配时清零用，避免每次创建切片
+var zeroBuf [_MaxSmallSize]byte
+
+// clearBytes 清零[addr, addr+size)
+func clearBytes(addr, size uintptr) {
+	for size > 0 {
+		n := uintptr(copy(rawBytes(addr, size), zeroBuf[:]))
+		addr, size = addr+n, size-n
+	}
+}
+
+// AllocBatch 分配n(不超过len(out))个size大小的对象到out中，size class只查找一次，每次从一个span中连续取出slot。
+// 返回分配的个数，出错时out中前面已经分配的对象仍然有效
+func (sp *xSpanPool) AllocBatch(size uintptr, n int, out []unsafe.Pointer) (int, error) {
+	if n > len(out) {
+		n = len(out)
+	}
+	if size > _MaxSmallSize || sp.needGuard(size) || sp.heap.debug != nil || sp.heap.opts.TrackSizes {
+		// 调试模式和大对象逐个分配
+		for i := 0; i < n; i++ {
+			p, err := sp.Alloc(size)
+			if err != nil {
+				return i, err
+			}
+			out[i] = p
+		}
+		return n, nil
+	}
+	sizeclass := sp.heap.classes.sizeToClass(size)
+	size = uintptr(sp.heap.classes.size[sizeclass])
+	got := 0
+	for got < n {
+		spans, spanGen := sp.getSpan(sizeclass)
+		for _, span := range spans {
+			if span == nil {
+				continue
+			}
+			k := span.nextFreeN(out[got:n])
+			for _, p := range out[got : got+k] {
+				clearBytes(uintptr(p), size)
+			}
+			if got += k; got == n {
+				break
+			}
+		}
+		if got == n {
+			if last := len(spans) - 1; last >= 0 && spans[last].needGrow() {
+				if _, need, _ := sp.needExpendAsync(sizeclass, ExpendAsync); need {
+					go sp.growSpan(sizeclass, ExpendAsync, spanGen)
+				}
+			}
+			break
+		}
+		// 所有span都用完了，去掉用完的并同步扩容
+		if err := sp.growSpan(sizeclass, RemoveHead, spanGen); err != nil {
+			return got, err
+		}
+		if err := sp.growSpan(sizeclass, ExpendSync, spanGen); err != nil {
+			return got, err
+		}
+	}
+	return n, nil
+}
+
+// FreeBatch 批量释放，按span分组后设置释放标记，最后统一触发sweep。
+// 先校验整批地址，有重复、内部指针或不在堆中的地址时返回错误，不释放任何对象
+func (sp *xSpanPool) FreeBatch(addrs []uintptr) error {
+	if sp.heap.debug != nil || sp.heap.opts.GuardPages {
+		for _, addr := range addrs {
+			if err := sp.Free(addr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sorted := append([]uintptr(nil), addrs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	type group struct {
+		span *xSpan
+		i, j int
+	}
+	var groups []group
+	for i := 0; i < len(sorted); {
+		span, err := sp.heap.spanOf(sorted[i])
+		if err != nil {
+			return err
+		}
+		if span == nil {
+			return fmt.Errorf("addr(%d) is not in any span", sorted[i])
+		}
+		end := span.startAddr + span.npages*_PageSize
+		j := i
+		for ; j < len(sorted) && sorted[j] < end; j++ {
+			// 标记是翻转的，重复的地址会把标记翻回去
+			if j > i && sorted[j] == sorted[j-1] {
+				return fmt.Errorf("addr(%d): %w", sorted[j], DuplicateFreeError)
+			}
+			if base, _ := slotOf(span, sorted[j]); base != sorted[j] {
+				return fmt.Errorf("addr(%d): %w", sorted[j], InteriorPointerError)
+			}
+		}
+		groups = append(groups, group{span, i, j})
+		i = j
+	}
+	for _, g := range groups {
+		for _, addr := range sorted[g.i:g.j] {
+			g.span.markBitsForIndex(g.span.objIndex(addr)).setMarked()
+		}
+		sp.heap.addFreeCapacity(int64(uintptr(g.j-g.i) * g.span.classSize))
+	}
+	sp.heap.sweep()
+	return nil
+}
+
 func (sp *xSpanPool) clear(ptr, size uintptr) (err error) {
 	dst := *(*[]byte)(unsafe.Pointer(&reflect.SliceHeader{Data: ptr, Len: int(size), Cap: int(size)}))
 	if length := copy(dst, make([]byte, size)); int(size) != length {
@@ -208,6 +352,9 @@ func (sp *xSpanPool) growSpan(sizeClass uint8, op SpanOperation, spanGen int32)
 	if val != nil {
 		span = *(*[]*xSpan)(val)
 	}
+	if atomic.LoadInt32(&sp.released) != 0 {
+		return SpanPoolReleasedError
+	}
 	inuse := sp.inuse[sizeClass]
 	if spanGen < 0 {
 		spanGen = 1
@@ -256,6 +403,27 @@ func (sp *xSpanPool) growSpan(sizeClass uint8, op SpanOperation, spanGen int32)
 	}
 }
 
+// release 把各class正在分配的span还给页堆，之后不能再从sp分配。
+// 只用于专用的spanPool(见newXConcurrentHashMapSpanPool)，调用方需要保证其中的对象都已经释放
+func (sp *xSpanPool) release() error {
+	atomic.StoreInt32(&sp.released, 1)
+	var err error
+	for class := range sp.spans {
+		sp.lock[class].Lock()
+		spans, _ := sp.getSpan(uint8(class))
+		for _, span := range spans {
+			// 释放时记的freeCapacity不会再被sweep
+			sp.heap.addFreeCapacity(-int64(span.countGcMarkBits() * span.classSize))
+			if e := sp.heap.releasePages(span); e != nil && err == nil {
+				err = e
+			}
+		}
+		atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&sp.spans[class])), nil)
+		sp.lock[class].Unlock()
+	}
+	return err
+}
+
 func (sp *xSpanPool) getSpan(sizeClass uint8) (spans []*xSpan, spanGen int32) {
 	addr := (*unsafe.Pointer)(unsafe.Pointer(&sp.spans[sizeClass]))
 	val := atomic.LoadPointer(addr)
@@ -307,22 +475,120 @@ func (sp *xSpanPool) Copy2(item1 []byte, item2 []byte) (newItem1 []byte, newItem
 	return str1, str2, err
 }
 
+// CopyN 一次分配拷贝多个byte数组，返回的数组共用一块内存，通过FreeGroup释放。长度为0的返回nil
+func (sp *xSpanPool) CopyN(items ...[]byte) ([][]byte, error) {
+	rawSize := 0
+	for _, item := range items {
+		rawSize += len(item)
+	}
+	out := make([][]byte, len(items))
+	if rawSize < 1 {
+		return out, nil
+	}
+	dataPtr, err := sp.Alloc(uintptr(rawSize))
+	if err != nil {
+		return nil, err
+	}
+	offset := uintptr(dataPtr)
+	for i, item := range items {
+		if len(item) == 0 {
+			continue
+		}
+		dst := rawBytes(offset, uintptr(len(item)))
+		copy(dst, item)
+		out[i] = dst
+		offset += uintptr(len(item))
+	}
+	return out, nil
+}
+
 var TestBbulks uintptr
 
 func (sp *xSpanPool) Free(addr uintptr) error {
+	if span := sp.heap.guardedSpanOf(addr); span != nil {
+		return sp.heap.freeGuarded(span, addr)
+	}
+	if sp.heap.debug != nil {
+		if span, err := sp.heap.spanOf(addr); err == nil && span != nil {
+			return sp.heap.debug.free(sp.heap, span, addr)
+		}
+	}
 	return sp.heap.free(addr)
 }
 
+// FreeGroup 释放addr所在的整个对象，addr可以是Copy2/CopyN/From2/FromN返回的任一元素的地址
+func (sp *xSpanPool) FreeGroup(addr uintptr) error {
+	base, err := sp.heap.objectBase(addr)
+	if err != nil {
+		return err
+	}
+	return sp.Free(base)
+}
+
 func newXConcurrentHashMapSpanPool(heap *xHeap, spanFact float32, pageNumCoefficient uint8) (*xSpanPool, error) {
 	sp := &xSpanPool{heap: heap, spanFact: spanFact, classSpan: heap.classSpan}
-	sp.specialPageNumCoefficient[1], sp.specialPageNumCoefficient[2], sp.specialPageNumCoefficient[4], sp.specialPageNumCoefficient[6] =
-		pageNumCoefficient*10, pageNumCoefficient*5, pageNumCoefficient*1, pageNumCoefficient*1
 	if err := sp.initLock(); err != nil {
 		return nil, err
 	}
+	// 默认表中为1、2、4、6号class，按大小查找以兼容自定义的size class表
+	classes := heap.classes
+	sp.specialPageNumCoefficient[classes.sizeToClass(8)], sp.specialPageNumCoefficient[classes.sizeToClass(16)],
+		sp.specialPageNumCoefficient[classes.sizeToClass(48)], sp.specialPageNumCoefficient[classes.sizeToClass(80)] =
+		pageNumCoefficient*10, pageNumCoefficient*5, pageNumCoefficient*1, pageNumCoefficient*1
 	return sp, nil
 }
 
+type spanKind uint8
+
+const (
+	spanInUse spanKind = iota // xSpanPool.spans 中正在分配的span
+	spanFree                  // xClassSpan.free
+	spanFull                  // xClassSpan.full
+	spanRaw                   // RawAlloc分配的span
+)
+
+// foreachSpan 遍历所有可达的span，同一个span只回调一次，fn返回错误时终止遍历
+func (sp *xSpanPool) foreachSpan(fn func(span *xSpan, kind spanKind) error) error {
+	visited := make(map[*xSpan]struct{})
+	visit := func(span *xSpan, kind spanKind) error {
+		if span == nil {
+			return nil
+		}
+		if _, ok := visited[span]; ok {
+			return nil
+		}
+		visited[span] = struct{}{}
+		return fn(span, kind)
+	}
+	visitList := func(list *mSpanList, kind spanKind) error {
+		list.lock.Lock()
+		defer list.lock.Unlock()
+		for span := list.first; span != nil; span = span.next {
+			if err := visit(span, kind); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := range sp.spans {
+		spans, _ := sp.getSpan(uint8(i))
+		for _, span := range spans {
+			if err := visit(span, spanInUse); err != nil {
+				return err
+			}
+		}
+	}
+	for _, classSpan := range sp.classSpan {
+		if err := visitList(classSpan.full, spanFull); err != nil {
+			return err
+		}
+		if err := visitList(classSpan.free, spanFree); err != nil {
+			return err
+		}
+	}
+	return visitList(&sp.heap.rawSpans, spanRaw)
+}
+
 // 启动利用class_to_allocnpages 预先分配span。
 // alloc超过阈值，异步预分配
 // alloc没有空闲时候，同步分配（防止分配太多）。
@@ -19,6 +19,7 @@
 package xmm
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -174,3 +175,227 @@ func Test_SanPool_Find(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAllocBatch(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]unsafe.Pointer, 10000)
+	// 先弄脏内存，确认批量分配会清零
+	for _, size := range []uintptr{24, 1000, _MaxSmallSize + 1} {
+		n, err := m.AllocBatch(size, 100, out)
+		if err != nil || n != 100 {
+			t.Fatal(n, err)
+		}
+		addrs := make([]uintptr, n)
+		for i, p := range out[:n] {
+			copy(rawBytes(uintptr(p), size), make([]byte, size))
+			rawBytes(uintptr(p), size)[0] = 0xff
+			addrs[i] = uintptr(p)
+		}
+		if err := m.FreeBatch(addrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, size := range []uintptr{24, 1000, _MaxSmallSize + 1} {
+		count := len(out)
+		if size > _MaxSmallSize {
+			count = 10
+		}
+		n, err := m.AllocBatch(size, count+100, out[:count])
+		if err != nil || n != count {
+			t.Fatal(n, err)
+		}
+		seen := make(map[unsafe.Pointer]bool, n)
+		for i, p := range out[:n] {
+			if seen[p] {
+				t.Fatal("duplicate", p)
+			}
+			seen[p] = true
+			b := rawBytes(uintptr(p), size)
+			for _, c := range b {
+				if c != 0 {
+					t.Fatal("not zeroed", size, i)
+				}
+			}
+			b[0], b[size-1] = byte(i), byte(i)
+		}
+		for i, p := range out[:n] {
+			if b := rawBytes(uintptr(p), size); b[0] != byte(i) || b[size-1] != byte(i) {
+				t.Fatal("overlap", size, i)
+			}
+		}
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	var live int
+	m.Walk(func(obj ObjectInfo) bool {
+		live++
+		return true
+	})
+	if live != len(out)*2+10 {
+		t.Fatal(live)
+	}
+}
+
+func TestFreeBatch(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]unsafe.Pointer, 5000)
+	n, err := m.AllocBatch(48, len(out), out)
+	if err != nil || n != len(out) {
+		t.Fatal(n, err)
+	}
+	var addrs []uintptr
+	for i, p := range out {
+		if i%3 != 0 {
+			addrs = append(addrs, uintptr(p))
+		}
+	}
+	// 打乱顺序
+	for i := range addrs {
+		j := (i * 7919) % len(addrs)
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	}
+	if err := m.FreeBatch(addrs); err != nil {
+		t.Fatal(err)
+	}
+	var live int
+	m.Walk(func(obj ObjectInfo) bool {
+		live++
+		return true
+	})
+	if live != len(out)-len(addrs) {
+		t.Fatal(live, len(out)-len(addrs))
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.FreeBatch([]uintptr{1}); err == nil {
+		t.Fatal("addr is not in heap")
+	}
+
+	// 重复地址、内部指针以及中途的非法地址都不能释放任何对象
+	a, b := uintptr(out[0]), uintptr(out[3])
+	if err := m.FreeBatch([]uintptr{a, b, a}); !errors.Is(err, DuplicateFreeError) {
+		t.Fatal(err)
+	}
+	if err := m.FreeBatch([]uintptr{a, b + 8}); !errors.Is(err, InteriorPointerError) {
+		t.Fatal(err)
+	}
+	if err := m.FreeBatch([]uintptr{a, ^uintptr(0) >> 1, b}); err == nil {
+		t.Fatal("addr is not in heap")
+	}
+	live = 0
+	m.Walk(func(obj ObjectInfo) bool {
+		live++
+		return true
+	})
+	if live != len(out)-len(addrs) {
+		t.Fatal(live, len(out)-len(addrs))
+	}
+	if err := m.FreeBatch([]uintptr{b, a}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyN(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := [][]byte{[]byte("id"), nil, []byte("name"), []byte("address"), []byte("x")}
+	for round := 0; round < 1000; round++ {
+		out, err := m.CopyN(items...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := uintptr(unsafe.Pointer(&out[0][0]))
+		offset := uintptr(0)
+		for i, item := range items {
+			if string(out[i]) != string(item) {
+				t.Fatal(i, out[i])
+			}
+			if len(item) > 0 {
+				// 共用同一块内存
+				if uintptr(unsafe.Pointer(&out[i][0])) != base+offset {
+					t.Fatal("not in one allocation", i)
+				}
+				offset += uintptr(len(item))
+			}
+		}
+		// 任一元素都可以释放整块内存
+		elem := out[2+round%3]
+		if err := m.FreeGroup(uintptr(unsafe.Pointer(&elem[0]))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var live int
+	m.Walk(func(obj ObjectInfo) bool {
+		live++
+		return true
+	})
+	if live != 0 {
+		t.Fatal("live objects", live)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := m.CopyN(nil, []byte{}); err != nil || len(out) != 2 || out[0] != nil || out[1] != nil {
+		t.Fatal(out, err)
+	}
+}
+
+func TestFromN(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs, err := m.FromN("a", "bb", "", "cccc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strs) != 4 || strs[0] != "a" || strs[1] != "bb" || strs[2] != "" || strs[3] != "cccc" {
+		t.Fatal(strs)
+	}
+	if err := m.FreeStringGroup(strs[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	// 释放From2的第二个string是内部指针，不能破坏bitmap
+	s1, s2, err := m.From2("key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1 != "key" || s2 != "value" {
+		t.Fatal(s1, s2)
+	}
+	if err := m.FreeString(s2); err != InteriorPointerError {
+		t.Fatal("interior pointer", err)
+	}
+	if err := m.FreeStringGroup(s2); err != nil {
+		t.Fatal(err)
+	}
+	var live int
+	m.Walk(func(obj ObjectInfo) bool {
+		live++
+		return true
+	})
+	if live != 0 {
+		t.Fatal("live objects", live)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
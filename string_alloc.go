@@ -51,26 +51,17 @@ func (sa *xStringAllocator) alloc(size uintptr) (sh *reflect.StringHeader, err e
 	return sh, nil
 }
 
-// todo  这里有bug，StringHeader没有计算进去，应该使用[]byte
+// FromInAddr 在addr处依次写入每个字符串的StringHeader和紧跟其后的内容(交错布局，和PackStrings不同)，
+// 总大小和StringArenaSize(contents...)相同
 func (sa *xStringAllocator) FromInAddr(addr uintptr, contents ...string) (p []*string, err error) {
 	offset := addr
 	p = make([]*string, len(contents))
 	for i, content := range contents {
-		size := uintptr(len(content))
 		sh := (*reflect.StringHeader)(unsafe.Pointer(offset))
-		sh.Len = int(size)
 		offset += unsafe.Sizeof(reflect.StringHeader{})
-
-		sh.Data = offset
-		offset += size
-		dst := reflect.SliceHeader{Data: sh.Data, Len: sh.Len, Cap: sh.Len}
-		dstBytes := *(*[]byte)(unsafe.Pointer(&dst))
-		sourcePtr := (*reflect.StringHeader)(unsafe.Pointer(&content))
-		source := reflect.SliceHeader{Data: sourcePtr.Data, Len: sourcePtr.Len, Cap: sourcePtr.Len}
-		srcByte := *(*[]byte)(unsafe.Pointer(&source))
-		if len := copy(dstBytes, srcByte); len != sh.Len {
-			return nil, fmt.Errorf("copy length is err: len = %d", len)
-		}
+		sh.Data, sh.Len = offset, len(content)
+		copy(rawBytes(offset, uintptr(len(content))), content)
+		offset += uintptr(len(content))
 		p[i] = (*string)(unsafe.Pointer(sh))
 	}
 	return p, nil
@@ -99,6 +90,39 @@ func (sa *xStringAllocator) From2(item1 string, item2 string) (newItem1 string,
 	return str1, str2, err
 }
 
+// FromN 一次分配拷贝多个string，返回的string共用一块内存，通过FreeGroup/FreeStringGroup释放
+func (sa *xStringAllocator) FromN(items ...string) ([]string, error) {
+	rawSize := 0
+	for _, item := range items {
+		rawSize += len(item)
+	}
+	out := make([]string, len(items))
+	if rawSize < 1 {
+		return out, nil
+	}
+	dataPtr, err := sa.sp.Alloc(uintptr(rawSize))
+	if err != nil {
+		return nil, err
+	}
+	offset := uintptr(dataPtr)
+	for i, item := range items {
+		if len(item) == 0 {
+			continue
+		}
+		copy(rawBytes(offset, uintptr(len(item))), item)
+		sh := (*reflect.StringHeader)(unsafe.Pointer(&out[i]))
+		sh.Data, sh.Len = offset, len(item)
+		offset += uintptr(len(item))
+	}
+	return out, nil
+}
+
+// FreeStringGroup 释放content所在的整个对象，content可以是From2/FromN返回的任一string
+func (sa *xStringAllocator) FreeStringGroup(content string) error {
+	sh := (*reflect.StringHeader)(unsafe.Pointer(&content))
+	return sa.sp.FreeGroup(sh.Data)
+}
+
 func (sa *xStringAllocator) From(content string) (p string, err error) {
 	size := uintptr(len(content))
 	dataPtr, err := sa.sp.Alloc(size)
@@ -0,0 +1,188 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// stringArenaBlockSize Append时新分配的块大小，超过的字符串单独分配
+const stringArenaBlockSize = _PageSize
+
+var StringArenaFreedError = errors.New("string arena is freed")
+
+// StringArenaSize 把contents打包到一块内存(StringHeader在前，内容在后)需要的精确大小，起始地址需要8字节对齐
+func StringArenaSize(contents ...string) uintptr {
+	size := uintptr(len(contents)) * unsafe.Sizeof(reflect.StringHeader{})
+	for _, s := range contents {
+		size += uintptr(len(s))
+	}
+	return size
+}
+
+// packStrings 在addr处依次写入len(contents)个StringHeader，之后是字符串内容，返回指向StringHeader的指针
+func packStrings(addr uintptr, contents []string) []*string {
+	p := make([]*string, len(contents))
+	data := addr + uintptr(len(contents))*unsafe.Sizeof(reflect.StringHeader{})
+	for i, s := range contents {
+		sh := (*reflect.StringHeader)(unsafe.Pointer(addr + uintptr(i)*unsafe.Sizeof(reflect.StringHeader{})))
+		sh.Data, sh.Len = data, len(s)
+		copy(rawBytes(data, uintptr(len(s))), s)
+		data += uintptr(len(s))
+		p[i] = (*string)(unsafe.Pointer(sh))
+	}
+	return p
+}
+
+// StringArena 把多个字符串打包到连续的XMM内存中，通过Free一次全部释放。
+// 多个string字段的记录可以用PackStrings放在同一块内存中；零散的字符串用Append追加到页大小的块中
+type StringArena struct {
+	lock   sync.Mutex
+	m      XMemory
+	blocks []uintptr // 所有分配的块，Free时释放
+	cur    uintptr   // 当前块的空闲位置
+	end    uintptr   // 当前块的结束位置
+	used   uintptr
+}
+
+// NewStringArena 创建空的StringArena，第一次写入时才分配内存
+func NewStringArena(m XMemory) (*StringArena, error) {
+	if m == nil {
+		return nil, NilError
+	}
+	return &StringArena{m: m}, nil
+}
+
+// PackStrings 按StringArenaSize一次分配contents需要的内存，返回arena和指向arena中字符串的指针
+func PackStrings(m XMemory, contents ...string) (*StringArena, []*string, error) {
+	a, err := NewStringArena(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := StringArenaSize(contents...)
+	if size == 0 {
+		return a, make([]*string, len(contents)), nil
+	}
+	addr, err := a.newBlock(size, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.used = size
+	return a, packStrings(addr, contents), nil
+}
+
+// newBlock 分配size大小的块，返回其中want大小的空间；块比当前块剩余的多时替换当前块
+func (a *StringArena) newBlock(size, want uintptr) (uintptr, error) {
+	p, err := a.m.Alloc(size)
+	if err != nil {
+		return 0, err
+	}
+	addr := uintptr(p)
+	a.blocks = append(a.blocks, addr)
+	if size-want > a.end-a.cur {
+		a.cur, a.end = addr+want, addr+size
+	}
+	return addr, nil
+}
+
+// reserve 从当前块中取出size字节(align对齐)，不够时分配新块
+func (a *StringArena) reserve(size, align uintptr) (uintptr, error) {
+	if a.m == nil {
+		return 0, StringArenaFreedError
+	}
+	if a.cur != 0 {
+		if p := Align(a.cur, align); p+size <= a.end {
+			a.cur = p + size
+			a.used += size
+			return p, nil
+		}
+	}
+	blockSize := uintptr(stringArenaBlockSize)
+	if size > blockSize/4 {
+		// 大字符串单独分配，不浪费当前块
+		blockSize = size
+	}
+	p, err := a.newBlock(blockSize, size)
+	if err != nil {
+		return 0, err
+	}
+	a.used += size
+	return p, nil
+}
+
+// Pack 把contents(StringHeader和内容)连续写入arena，返回指向arena中字符串的指针
+func (a *StringArena) Pack(contents ...string) ([]*string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	size := StringArenaSize(contents...)
+	if size == 0 {
+		return make([]*string, len(contents)), nil
+	}
+	addr, err := a.reserve(size, unsafe.Alignof(reflect.StringHeader{}))
+	if err != nil {
+		return nil, err
+	}
+	return packStrings(addr, contents), nil
+}
+
+// Append 把s的内容拷贝到arena中
+func (a *StringArena) Append(s string) (string, error) {
+	if len(s) == 0 {
+		return "", nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	addr, err := a.reserve(uintptr(len(s)), 1)
+	if err != nil {
+		return "", err
+	}
+	copy(rawBytes(addr, uintptr(len(s))), s)
+	var p string
+	sh := (*reflect.StringHeader)(unsafe.Pointer(&p))
+	sh.Data, sh.Len = addr, len(s)
+	return p, nil
+}
+
+// Size 已经写入的字节数(包括StringHeader)
+func (a *StringArena) Size() uintptr {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.used
+}
+
+// Free 释放arena的所有内存，之后arena中的字符串都不能再使用
+func (a *StringArena) Free() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.m == nil {
+		return nil
+	}
+	var err error
+	for _, addr := range a.blocks {
+		if e := a.m.Free(addr); e != nil && err == nil {
+			err = e
+		}
+	}
+	a.m, a.blocks = nil, nil
+	a.cur, a.end, a.used = 0, 0, 0
+	return err
+}
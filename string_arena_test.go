@@ -0,0 +1,145 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestPackStrings(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{"name", "", "address", strings.Repeat("d", 300)}
+	size := StringArenaSize(contents...)
+	if want := 4*unsafe.Sizeof(reflect.StringHeader{}) + 4 + 7 + 300; size != want {
+		t.Fatal(size, want)
+	}
+	a, p, err := PackStrings(m, contents...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 所有StringHeader和内容都在同一块[start, start+size)中
+	start := uintptr(unsafe.Pointer(p[0]))
+	for i, s := range p {
+		if *s != contents[i] {
+			t.Fatal(i, *s)
+		}
+		if addr := uintptr(unsafe.Pointer(s)); addr < start || addr >= start+size {
+			t.Fatal("header out of block", i)
+		}
+		if data := stringData(*s); len(*s) > 0 && (data < start || data+uintptr(len(*s)) > start+size) {
+			t.Fatal("data out of block", i)
+		}
+	}
+	if a.Size() != size {
+		t.Fatal(a.Size(), size)
+	}
+	if err := a.Free(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Append("x"); err != StringArenaFreedError {
+		t.Fatal(err)
+	}
+}
+
+func TestStringArena(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewStringArena(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []string
+	var recs [][]*string
+	for i := 0; i < 2000; i++ {
+		s, err := a.Append(fmt.Sprintf("value-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		strs = append(strs, s)
+		rec, err := a.Pack(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uintptr(unsafe.Pointer(rec[0]))%unsafe.Alignof(reflect.StringHeader{}) != 0 {
+			t.Fatal("header not aligned")
+		}
+		recs = append(recs, rec)
+	}
+	big, err := a.Append(strings.Repeat("b", 3*_PageSize))
+	if err != nil || big != strings.Repeat("b", 3*_PageSize) {
+		t.Fatal("big", err)
+	}
+	for i, s := range strs {
+		if s != fmt.Sprintf("value-%d", i) || *recs[i][0] != fmt.Sprintf("k%d", i) || *recs[i][1] != fmt.Sprintf("v%d", i) {
+			t.Fatal(i, s)
+		}
+		if _, err := m.(*mm).h.spanOf(stringData(s)); err != nil {
+			t.Fatal("not in xmm", err)
+		}
+	}
+	// 小字符串按页大小的块分配
+	if n := len(a.blocks); n > 2000*64/stringArenaBlockSize+2 {
+		t.Fatal("too many blocks", n)
+	}
+	if err := a.Free(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// FromInAddr保持原来的交错布局：StringHeader后紧跟内容
+func TestFromInAddrLayout(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{"key", "value"}
+	size := StringArenaSize(contents...)
+	addr, err := m.Alloc(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := m.FromInAddr(uintptr(addr), contents...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := unsafe.Sizeof(reflect.StringHeader{})
+	offset := uintptr(addr)
+	for i, s := range contents {
+		sh := (*reflect.StringHeader)(unsafe.Pointer(p[i]))
+		if uintptr(unsafe.Pointer(p[i])) != offset || sh.Data != offset+hs || *p[i] != s {
+			t.Fatal(i, *p[i])
+		}
+		offset += hs + uintptr(len(s))
+	}
+	if offset != uintptr(addr)+size {
+		t.Fatal(offset-uintptr(addr), size)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"unsafe"
+)
+
+const (
+	tableIndexBits = 28
+	tableIndexMask = 1<<tableIndexBits - 1
+	tableGenMask   = 1<<(32-tableIndexBits) - 1
+	tableAlive     = 0x80
+
+	// tableChunkBytes 每个chunk的目标大小
+	tableChunkBytes = 64 << 10
+)
+
+var TableFullError = errors.New("table is full")
+
+// Table 定长记录表，记录连续存放在Alloc分配的chunk中，通过32位ID访问(高4位为generation，低28位为下标)，
+// 删除后的ID不会再访问到新记录(generation循环15次后才会重复)。按chunk扩容，已有的记录不会移动。
+// T中不能保存Go指针；不支持并发写，读写并发需要调用方加锁
+type Table[T any] struct {
+	m       XMemory
+	size    uintptr
+	shift   uint    // 每个chunk 1<<shift 条记录
+	metaOff uintptr // chunk中generation字节的起始偏移，每条记录1字节：tableAlive|gen
+	pages   uintptr
+	chunks  []uintptr
+	next    uint32 // 没有使用过的第一个下标
+	free    []uint32
+	count   int
+}
+
+// NewTable 创建定长记录表
+func NewTable[T any](m XMemory) (*Table[T], error) {
+	if m == nil {
+		return nil, NilError
+	}
+	var v T
+	size := unsafe.Sizeof(v)
+	if size == 0 {
+		return nil, errors.New("size of T is 0")
+	}
+	t := &Table[T]{m: m, size: size}
+	// 每个chunk的记录数取2的幂，下标到chunk只需要移位
+	for (uintptr(2)<<t.shift)*(size+1) <= tableChunkBytes && t.shift+1 < tableIndexBits {
+		t.shift++
+	}
+	t.metaOff = (uintptr(1) << t.shift) * size
+	t.pages = Align(t.metaOff+uintptr(1)<<t.shift, _PageSize) / _PageSize
+	return t, nil
+}
+
+func tableID(index uint32, gen uint8) uint32 {
+	return uint32(gen)<<tableIndexBits | index
+}
+
+// slot 下标对应的记录地址和generation字节
+func (t *Table[T]) slot(index uint32) (uintptr, *uint8) {
+	base := t.chunks[index>>t.shift]
+	i := uintptr(index) & (uintptr(1)<<t.shift - 1)
+	return base + i*t.size, (*uint8)(unsafe.Pointer(base + t.metaOff + i))
+}
+
+// Insert 插入一条记录，返回它的ID
+func (t *Table[T]) Insert(v T) (uint32, error) {
+	var index uint32
+	if n := len(t.free); n > 0 {
+		index, t.free = t.free[n-1], t.free[:n-1]
+	} else {
+		if t.next > tableIndexMask {
+			return 0, TableFullError
+		}
+		if int(t.next>>t.shift) == len(t.chunks) {
+			p, err := t.m.Alloc(t.pages * _PageSize)
+			if err != nil {
+				return 0, err
+			}
+			// 复用的内存可能有旧数据，清空generation
+			chunk := uintptr(p)
+			clearBytes(chunk+t.metaOff, uintptr(1)<<t.shift)
+			t.chunks = append(t.chunks, chunk)
+		}
+		index = t.next
+		t.next++
+	}
+	addr, meta := t.slot(index)
+	*(*T)(unsafe.Pointer(addr)) = v
+	gen := *meta & tableGenMask
+	if gen == 0 {
+		gen = 1
+	}
+	*meta = tableAlive | gen
+	t.count++
+	return tableID(index, gen), nil
+}
+
+// Get 返回ID对应的记录，ID非法或者记录已删除时返回nil
+func (t *Table[T]) Get(id uint32) *T {
+	index := id & tableIndexMask
+	if index >= t.next {
+		return nil
+	}
+	addr, meta := t.slot(index)
+	if *meta != tableAlive|uint8(id>>tableIndexBits) {
+		return nil
+	}
+	return (*T)(unsafe.Pointer(addr))
+}
+
+// Delete 删除记录，下标之后被复用
+func (t *Table[T]) Delete(id uint32) bool {
+	if t.Get(id) == nil {
+		return false
+	}
+	index := id & tableIndexMask
+	_, meta := t.slot(index)
+	gen := *meta&tableGenMask + 1
+	if gen > tableGenMask {
+		gen = 1
+	}
+	*meta = gen
+	t.free = append(t.free, index)
+	t.count--
+	return true
+}
+
+// Len 记录数
+func (t *Table[T]) Len() int {
+	return t.count
+}
+
+// Range 按下标顺序遍历记录，fn返回false时停止。fn中可以Delete当前记录
+func (t *Table[T]) Range(fn func(id uint32, v *T) bool) {
+	for index := uint32(0); index < t.next; index++ {
+		addr, meta := t.slot(index)
+		if m := *meta; m&tableAlive != 0 {
+			if !fn(tableID(index, m&tableGenMask), (*T)(unsafe.Pointer(addr))) {
+				return
+			}
+		}
+	}
+}
+
+// Free 把所有chunk还给XMemory，之前的ID全部失效，Table变为空表可以继续使用
+func (t *Table[T]) Free() error {
+	var err error
+	for _, chunk := range t.chunks {
+		if e := t.m.Free(chunk); e != nil && err == nil {
+			err = e
+		}
+	}
+	t.chunks, t.free = nil, nil
+	t.next, t.count = 0, 0
+	return err
+}
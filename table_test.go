@@ -0,0 +1,165 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"testing"
+)
+
+type tableRecord struct {
+	key   uint64
+	value uint32
+}
+
+func TestTable(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewTable[tableRecord](m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Get(0) != nil {
+		t.Fatal("id 0")
+	}
+	const n = 100000
+	ids := make([]uint32, n)
+	addrs := make([]*tableRecord, n)
+	for i := range ids {
+		if ids[i], err = table.Insert(tableRecord{key: uint64(i), value: uint32(i) * 2}); err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = table.Get(ids[i])
+	}
+	if len(table.chunks) < 2 || table.Len() != n {
+		t.Fatal(len(table.chunks), table.Len())
+	}
+	// 扩容不移动已有记录
+	for i, id := range ids {
+		r := table.Get(id)
+		if r != addrs[i] || r.key != uint64(i) || r.value != uint32(i)*2 {
+			t.Fatal(i, r)
+		}
+	}
+	for i := 0; i < n; i += 2 {
+		if !table.Delete(ids[i]) {
+			t.Fatal(i)
+		}
+	}
+	if table.Delete(ids[0]) || table.Get(ids[0]) != nil || table.Len() != n/2 {
+		t.Fatal("stale id")
+	}
+	// 复用下标，旧ID仍然无效
+	id, err := table.Insert(tableRecord{key: 1 << 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id&tableIndexMask != ids[n-2]&tableIndexMask || id == ids[n-2] || table.Get(ids[n-2]) != nil {
+		t.Fatal(id, ids[n-2])
+	}
+	if r := table.Get(id); r == nil || r.key != 1<<40 {
+		t.Fatal(r)
+	}
+	var count int
+	last := int64(-1)
+	table.Range(func(id uint32, v *tableRecord) bool {
+		if int64(id&tableIndexMask) <= last || table.Get(id) != v {
+			t.Fatal(id)
+		}
+		last = int64(id & tableIndexMask)
+		count++
+		return true
+	})
+	if count != n/2+1 {
+		t.Fatal(count)
+	}
+}
+
+func TestTableGeneration(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewTable[uint16](m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[uint32]bool)
+	for i := 0; i < tableGenMask; i++ {
+		id, err := table.Insert(uint16(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id&tableIndexMask != 0 || seen[id] || id>>tableIndexBits == 0 {
+			t.Fatal(i, id)
+		}
+		seen[id] = true
+		if *table.Get(id) != uint16(i) || !table.Delete(id) {
+			t.Fatal(i)
+		}
+	}
+	// 15次之后generation循环
+	id, err := table.Insert(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !seen[id] {
+		t.Fatal(id)
+	}
+	if _, err := NewTable[struct{}](m); err == nil {
+		t.Fatal("zero size")
+	}
+}
+
+func TestTableFree(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemoryWithOptions(0.75, Options{TrackLeaks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewTable[tableRecord](m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uint32(0)
+	for i := 0; i < 10000; i++ {
+		if id, err = table.Insert(tableRecord{key: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.LeakReport()) == 0 {
+		t.Fatal("chunks not tracked")
+	}
+	if err := table.Free(); err != nil {
+		t.Fatal(err)
+	}
+	if leaks := m.LeakReport(); len(leaks) != 0 {
+		t.Fatal(leaks)
+	}
+	if table.Len() != 0 || table.Get(id) != nil {
+		t.Fatal("table not empty")
+	}
+	// Free之后可以继续使用
+	if id, err = table.Insert(tableRecord{key: 1}); err != nil || table.Get(id).key != 1 {
+		t.Fatal(err)
+	}
+}
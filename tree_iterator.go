@@ -0,0 +1,233 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import "errors"
+
+var ErrorConcurrentModification = errors.New("Tree was modified during iteration")
+
+// Min returns the node with the smallest key, nil if the tree is empty.
+func (t *Tree) Min() *NodeEntry {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.min()
+}
+
+// Max returns the node with the largest key, nil if the tree is empty.
+func (t *Tree) Max() *NodeEntry {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.max()
+}
+
+// Floor returns the node with the largest key <= key, nil if there is none.
+func (t *Tree) Floor(key []byte) *NodeEntry {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.floor(key)
+}
+
+// Ceiling returns the node with the smallest key >= key, nil if there is none.
+func (t *Tree) Ceiling(key []byte) *NodeEntry {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.ceiling(key)
+}
+
+// 以下不加锁的版本需要调用方持有锁
+
+func (t *Tree) min() *NodeEntry {
+	if t.root == nil {
+		return nil
+	}
+	return t.getMinimum(t.root)
+}
+
+func (t *Tree) max() *NodeEntry {
+	if t.root == nil {
+		return nil
+	}
+	return getMaximum(t.root)
+}
+
+func (t *Tree) floor(key []byte) *NodeEntry {
+	var floor *NodeEntry
+	for n := t.root; n != nil; {
+		switch c := t.cmp(key, n.Key); {
+		case c == 0:
+			return n
+		case c < 0:
+			n = n.left
+		default:
+			floor, n = n, n.right
+		}
+	}
+	return floor
+}
+
+func (t *Tree) ceiling(key []byte) *NodeEntry {
+	var ceiling *NodeEntry
+	for n := t.root; n != nil; {
+		switch c := t.cmp(key, n.Key); {
+		case c == 0:
+			return n
+		case c < 0:
+			ceiling, n = n, n.left
+		default:
+			n = n.right
+		}
+	}
+	return ceiling
+}
+
+func getMaximum(x *NodeEntry) *NodeEntry {
+	for x.right != nil {
+		x = x.right
+	}
+	return x
+}
+
+// successor 中序遍历的下一个节点，通过父指针向上查找
+func (t *Tree) successor(n *NodeEntry) *NodeEntry {
+	if n.right != nil {
+		return t.getMinimum(n.right)
+	}
+	p := n.parent
+	for p != nil && n == p.right {
+		n, p = p, p.parent
+	}
+	return p
+}
+
+// predecessor 中序遍历的上一个节点
+func (t *Tree) predecessor(n *NodeEntry) *NodeEntry {
+	if n.left != nil {
+		return getMaximum(n.left)
+	}
+	p := n.parent
+	for p != nil && n == p.left {
+		n, p = p, p.parent
+	}
+	return p
+}
+
+// TreeIterator walks a Tree in key order without recursion.
+// Each step takes the read lock, so the tree may be modified between steps:
+// the iterator then stops and Err returns ErrorConcurrentModification.
+//
+//	it := tree.Range(lo, hi)
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil { ... }
+type TreeIterator struct {
+	tree     *Tree
+	next     *NodeEntry
+	node     *NodeEntry
+	hi       []byte // Range的上界(不包含)，nil为没有上界
+	desc     bool
+	modCount uint64
+	err      error
+}
+
+// newIterator 起点和modCount在同一次加锁中取得，之后的修改都能被发现
+func (t *Tree) newIterator(pivot []byte, hi []byte, desc bool) *TreeIterator {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	var start *NodeEntry
+	switch {
+	case desc && pivot == nil:
+		start = t.max()
+	case desc:
+		start = t.floor(pivot)
+	case pivot == nil:
+		start = t.min()
+	default:
+		start = t.ceiling(pivot)
+	}
+	return &TreeIterator{tree: t, next: start, hi: hi, desc: desc, modCount: t.modCount}
+}
+
+// Ascend returns an iterator over keys >= pivot in ascending order, from the smallest key if pivot is nil.
+func (t *Tree) Ascend(pivot []byte) *TreeIterator {
+	return t.newIterator(pivot, nil, false)
+}
+
+// Descend returns an iterator over keys <= pivot in descending order, from the largest key if pivot is nil.
+func (t *Tree) Descend(pivot []byte) *TreeIterator {
+	return t.newIterator(pivot, nil, true)
+}
+
+// Range returns an iterator over keys in [lo, hi) in ascending order.
+// A nil lo starts from the smallest key, a nil hi has no upper bound.
+func (t *Tree) Range(lo, hi []byte) *TreeIterator {
+	return t.newIterator(lo, hi, false)
+}
+
+// Next advances the iterator, returns false when there are no more nodes or the tree was modified.
+func (it *TreeIterator) Next() bool {
+	it.node = nil
+	if it.err != nil || it.next == nil {
+		return false
+	}
+	it.tree.lock.RLock()
+	defer it.tree.lock.RUnlock()
+	if it.tree.modCount != it.modCount {
+		it.err = ErrorConcurrentModification
+		return false
+	}
+	n := it.next
+	if it.hi != nil && it.tree.cmp(n.Key, it.hi) >= 0 {
+		it.next = nil
+		return false
+	}
+	it.node = n
+	if it.desc {
+		it.next = it.tree.predecessor(n)
+	} else {
+		it.next = it.tree.successor(n)
+	}
+	return true
+}
+
+// Node returns the current node, it is only stable until the next write to the tree.
+func (it *TreeIterator) Node() *NodeEntry {
+	return it.node
+}
+
+// Key returns the key of the current node.
+func (it *TreeIterator) Key() []byte {
+	if it.node == nil {
+		return nil
+	}
+	return it.node.Key
+}
+
+// Value returns the value of the current node.
+func (it *TreeIterator) Value() []byte {
+	if it.node == nil {
+		return nil
+	}
+	return it.node.Value
+}
+
+// Err returns ErrorConcurrentModification if the tree was modified during iteration.
+func (it *TreeIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"fmt"
+	"testing"
+)
+
+func keysOf(it *TreeIterator) []string {
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+func TestTreeOrdered(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTreeIn(m, BytesAscSort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Min() != nil || tree.Max() != nil || tree.Ascend(nil).Next() {
+		t.Fatal("empty tree")
+	}
+	// 0, 10, 20, ... 990
+	for i := 990; i >= 0; i -= 10 {
+		if err := tree.PutKV([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(tree.Min().Key) != "0000" || string(tree.Max().Key) != "0990" {
+		t.Fatal(string(tree.Min().Key), string(tree.Max().Key))
+	}
+	if string(tree.Floor([]byte("0015")).Key) != "0010" || string(tree.Floor([]byte("0020")).Key) != "0020" || tree.Floor([]byte("")) != nil {
+		t.Fatal("floor")
+	}
+	if string(tree.Ceiling([]byte("0015")).Key) != "0020" || string(tree.Ceiling([]byte("0020")).Key) != "0020" || tree.Ceiling([]byte("1000")) != nil {
+		t.Fatal("ceiling")
+	}
+	all := keysOf(tree.Ascend(nil))
+	if len(all) != 100 || all[0] != "0000" || all[99] != "0990" {
+		t.Fatal(all)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1] >= all[i] {
+			t.Fatal("not ascending", all[i-1], all[i])
+		}
+	}
+	if got := fmt.Sprint(keysOf(tree.Range([]byte("0015"), []byte("0050")))); got != "[0020 0030 0040]" {
+		t.Fatal(got)
+	}
+	if got := fmt.Sprint(keysOf(tree.Descend([]byte("0035")))[:3]); got != "[0030 0020 0010]" {
+		t.Fatal(got)
+	}
+	if got := keysOf(tree.Descend(nil)); len(got) != 100 || got[0] != "0990" {
+		t.Fatal(got)
+	}
+	if got := keysOf(tree.Ascend([]byte("0985"))); fmt.Sprint(got) != "[0990]" {
+		t.Fatal(got)
+	}
+
+	// 迭代期间修改
+	it := tree.Ascend(nil)
+	if !it.Next() {
+		t.Fatal("next")
+	}
+	if err := tree.PutKV([]byte("0005"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if it.Next() || it.Err() != ErrorConcurrentModification {
+		t.Fatal("concurrent modification", it.Err())
+	}
+	if err := tree.Free(); err != nil {
+		t.Fatal(err)
+	}
+}
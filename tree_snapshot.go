@@ -0,0 +1,100 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import "sort"
+
+// TreeSnapshot is an immutable, sorted copy of a Tree taken at one point in time.
+// It is safe for concurrent use without any locking.
+type TreeSnapshot struct {
+	keys   [][]byte
+	values [][]byte
+	cmp    Comparator
+}
+
+// Snapshot returns the current snapshot of the tree. While there are no writes the
+// same snapshot is shared by all readers and is loaded without taking any lock;
+// the first read after a write builds a new one under the read lock.
+// The snapshot is a rebuilt sorted copy, not a path-copying (persistent) copy-on-write
+// root: writes stay in place so that nodes of trees created by NewTreeIn can be freed
+// immediately, instead of being shared with older versions.
+// Rebuilding copies the whole tree, so a workload that interleaves writes with
+// Snapshot calls pays O(n) per write (see BenchmarkTreeSnapshot_WriteEach in benchmark/);
+// it suits read-mostly trees, use Get or an iterator otherwise.
+// For trees created by NewTreeIn keys and values are copied to the Go heap,
+// so the snapshot stays valid after the nodes are freed.
+func (t *Tree) Snapshot() *TreeSnapshot {
+	if s, _ := t.snapshot.Load().(*TreeSnapshot); s != nil {
+		return s
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if s, _ := t.snapshot.Load().(*TreeSnapshot); s != nil {
+		return s
+	}
+	s := &TreeSnapshot{cmp: t.cmp}
+	for n := t.min(); n != nil; n = t.successor(n) {
+		key, value := n.Key, n.Value
+		if t.mem != nil {
+			key, value = append([]byte(nil), key...), append([]byte(nil), value...)
+		}
+		s.keys = append(s.keys, key)
+		s.values = append(s.values, value)
+	}
+	// 写操作持有写锁时才会清空，这里持有读锁发布不会覆盖更新的修改
+	t.snapshot.Store(s)
+	return s
+}
+
+// Len returns the number of keys in the snapshot.
+func (s *TreeSnapshot) Len() int {
+	return len(s.keys)
+}
+
+// search 返回第一个 >= key 的位置
+func (s *TreeSnapshot) search(key []byte) int {
+	return sort.Search(len(s.keys), func(i int) bool {
+		return s.cmp(s.keys[i], key) >= 0
+	})
+}
+
+// Get returns the value mapped to key and whether it was found.
+func (s *TreeSnapshot) Get(key []byte) ([]byte, bool) {
+	if i := s.search(key); i < len(s.keys) && s.cmp(s.keys[i], key) == 0 {
+		return s.values[i], true
+	}
+	return nil, false
+}
+
+// Range calls fn for keys in [lo, hi) in ascending order until fn returns false.
+// A nil lo starts from the smallest key, a nil hi has no upper bound.
+func (s *TreeSnapshot) Range(lo, hi []byte, fn func(key, value []byte) bool) {
+	i := 0
+	if lo != nil {
+		i = s.search(lo)
+	}
+	for ; i < len(s.keys); i++ {
+		if hi != nil && s.cmp(s.keys[i], hi) >= 0 {
+			return
+		}
+		if !fn(s.keys[i], s.values[i]) {
+			return
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren/XMM
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTreeSnapshot(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTreeIn(m, BytesAscSort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := tree.Snapshot(); s.Len() != 0 {
+		t.Fatal(s.Len())
+	}
+	for i := 0; i < 100; i += 10 {
+		if err := tree.PutKV([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := tree.Snapshot()
+	if s != tree.Snapshot() {
+		t.Fatal("snapshot should be shared until the next write")
+	}
+	if _, err := tree.DeleteKV([]byte("0020")); err != nil {
+		t.Fatal(err)
+	}
+	// 删除后节点内存已释放，旧快照不受影响
+	if v, ok := s.Get([]byte("0020")); !ok || string(v) != "20" || s.Len() != 10 {
+		t.Fatal(string(v), ok, s.Len())
+	}
+	s2 := tree.Snapshot()
+	if s2 == s || s2.Len() != 9 {
+		t.Fatal("snapshot not rebuilt after write")
+	}
+	if _, ok := s2.Get([]byte("0020")); ok {
+		t.Fatal("deleted key in new snapshot")
+	}
+	if _, ok := s2.Get([]byte("0025")); ok {
+		t.Fatal("missing key found")
+	}
+	var keys []string
+	s2.Range([]byte("0015"), []byte("0060"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if fmt.Sprint(keys) != "[0030 0040 0050]" {
+		t.Fatal(keys)
+	}
+	keys = keys[:0]
+	s2.Range(nil, nil, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 2
+	})
+	if fmt.Sprint(keys) != "[0000 0010]" {
+		t.Fatal(keys)
+	}
+	if err := tree.Free(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTreeConcurrent 读写并发，用 go test -race 运行。XMM分配器本身的元数据不在此测试范围，这里用Go堆上的树
+func TestTreeConcurrent(t *testing.T) {
+	testTreeConcurrent(t, NewTreeWith(BytesAscSort))
+}
+
+// 节点在XMM中时，删除会释放节点和key/value，读者不能访问到已经释放的内存
+func TestTreeConcurrentInXMM(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTreeIn(m, BytesAscSort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTreeConcurrent(t, tree)
+	if err := tree.Free(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testTreeConcurrent(t *testing.T, tree *Tree) {
+	const writers, readers, n = 4, 4, 500
+	key := func(w, i int) []byte { return []byte(fmt.Sprintf("%d-%04d", w, i)) }
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := tree.PutKV(key(w, i), []byte(fmt.Sprint(i))); err != nil {
+					t.Error(err)
+					return
+				}
+				// 删掉一半
+				if i%2 == 1 {
+					if ok, err := tree.DeleteKV(key(w, i-1)); !ok || err != nil {
+						t.Error("delete", string(key(w, i-1)), ok, err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				tree.Get(key(r%writers, i))
+				tree.Has(key(r%writers, i))
+				tree.Size()
+				tree.Min()
+				tree.Ceiling(key(r%writers, i))
+				it := tree.Ascend(nil)
+				for it.Next() {
+					it.Key()
+				}
+				if it.Err() != nil && it.Err() != ErrorConcurrentModification {
+					t.Error(it.Err())
+					return
+				}
+				s := tree.Snapshot()
+				last := ""
+				s.Range(nil, nil, func(k, v []byte) bool {
+					if string(k) <= last {
+						t.Error("snapshot not sorted", last, string(k))
+						return false
+					}
+					last = string(k)
+					return true
+				})
+			}
+		}(r)
+	}
+	wg.Wait()
+	if got := checkTree(t, tree); got != writers*n/2 {
+		t.Fatal(got)
+	}
+	s := tree.Snapshot()
+	if s.Len() != writers*n/2 || uint64(s.Len()) != tree.Size() {
+		t.Fatal(s.Len(), tree.Size())
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < n; i++ {
+			_, ok := s.Get(key(w, i))
+			if has := tree.Has(key(w, i)); ok != has || ok != (i%2 == 1) {
+				t.Fatal(string(key(w, i)), ok, has)
+			}
+		}
+	}
+}
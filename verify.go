@@ -0,0 +1,295 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// VerifyError Verify发现的所有不一致
+type VerifyError struct {
+	Errs []error
+}
+
+// verifyErrorsShown Error()中最多展示的错误数
+const verifyErrorsShown = 20
+
+func (e *VerifyError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "xmm: heap verify found %d problems:", len(e.Errs))
+	for i, err := range e.Errs {
+		if i == verifyErrorsShown {
+			fmt.Fprintf(&b, "\n\t... and %d more", len(e.Errs)-i)
+			break
+		}
+		b.WriteString("\n\t")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Is 任意一个错误匹配target时返回true。go 1.18的errors.Is不支持Unwrap() []error，这里自己遍历
+func (e *VerifyError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As 把第一个能匹配的错误赋给target
+func (e *VerifyError) As(target interface{}) bool {
+	for _, err := range e.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+type heapVerifier struct {
+	h    *xHeap
+	errs []error
+}
+
+func (v *heapVerifier) errorf(format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf(format, args...))
+}
+
+// pageRange 一段连续的页，span或者空闲chunk
+type pageRange struct {
+	start, npages uintptr
+	span          *xSpan // 空闲chunk为nil
+}
+
+func (r pageRange) end() uintptr {
+	return r.start + r.npages*_PageSize
+}
+
+func (r pageRange) String() string {
+	if r.span == nil {
+		return fmt.Sprintf("free chunk [%#x, %#x)", r.start, r.end())
+	}
+	return fmt.Sprintf("span(class %d) [%#x, %#x)", r.span.classIndex, r.start, r.end())
+}
+
+// Verify 校验整个堆的一致性，返回*VerifyError，其中包含发现的所有问题：
+// treap的有序性和堆性质、空闲页和span不重叠、addrMap和span页范围一致、allocCount和allocBits一致、span不同时在free和full链表中。
+// 只读不修改堆，校验期间阻塞span扩容，但并发的Alloc/Free仍可能导致误报，需要准确结果时应暂停分配。
+func (m *mm) Verify() error {
+	sp, ok := m.sp.(*xSpanPool)
+	if !ok {
+		return errors.New("spanPool is not support verify")
+	}
+	// 和Snapshot一样锁住所有class，避免异步扩容在校验期间移动span
+	for i := range sp.lock {
+		sp.lock[i].Lock()
+		defer sp.lock[i].Unlock()
+	}
+	v := &heapVerifier{h: m.h}
+	spans := v.spanLists(sp)
+	for _, r := range spans {
+		v.span(r.span)
+	}
+	chunks := v.treap()
+	v.overlap(append(spans, chunks...))
+	v.addrMap(spans, chunks)
+	if len(v.errs) > 0 {
+		return &VerifyError{Errs: v.errs}
+	}
+	return nil
+}
+
+// spanLists 收集所有span，校验链表无环、span不同时在free和full中
+func (v *heapVerifier) spanLists(sp *xSpanPool) []pageRange {
+	where := make(map[*xSpan]string)
+	var spans []pageRange
+	add := func(span *xSpan, name string) {
+		if old, ok := where[span]; ok {
+			v.errorf("span %#x(class %d) is on both %s and %s", span.startAddr, span.classIndex, old, name)
+			return
+		}
+		where[span] = name
+		spans = append(spans, pageRange{start: span.startAddr, npages: span.npages, span: span})
+	}
+	visitList := func(list *mSpanList, name string) {
+		list.lock.Lock()
+		defer list.lock.Unlock()
+		seen := make(map[*xSpan]struct{})
+		for span := list.first; span != nil; span = span.next {
+			if _, ok := seen[span]; ok {
+				v.errorf("%s has a cycle at span %#x", name, span.startAddr)
+				return
+			}
+			seen[span] = struct{}{}
+			add(span, name)
+		}
+	}
+	for i, classSpan := range sp.classSpan {
+		visitList(classSpan.free, fmt.Sprintf("class %d free list", i))
+		visitList(classSpan.full, fmt.Sprintf("class %d full list", i))
+	}
+	visitList(&sp.heap.rawSpans, "raw span list")
+	for i := range sp.spans {
+		current, _ := sp.getSpan(uint8(i))
+		for _, span := range current {
+			if span != nil {
+				add(span, fmt.Sprintf("class %d current spans", i))
+			}
+		}
+	}
+	return spans
+}
+
+// span 校验span的元数据和bitmap
+func (v *heapVerifier) span(s *xSpan) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.npages == 0 || s.startAddr%_PageSize != 0 {
+		v.errorf("span %#x has bad page range npages(%d)", s.startAddr, s.npages)
+		return
+	}
+	if s.allocBits == nil || s.gcmarkBits == nil {
+		// RawAlloc分配的span没有bitmap
+		return
+	}
+	if s.classIndex == 0 {
+		if s.nelems != 1 || s.allocCount != 1 {
+			v.errorf("large span %#x has nelems(%d) allocCount(%d), want 1", s.startAddr, s.nelems, s.allocCount)
+		}
+		return
+	}
+	if int(s.classIndex) >= v.h.classes.num() || s.classSize != uintptr(v.h.classes.size[s.classIndex]) {
+		v.errorf("span %#x has bad class(%d) classSize(%d)", s.startAddr, s.classIndex, s.classSize)
+		return
+	}
+	if s.nelems != s.npages*_PageSize/s.classSize {
+		v.errorf("span %#x(class %d) has nelems(%d), want %d", s.startAddr, s.classIndex, s.nelems, s.npages*_PageSize/s.classSize)
+		return
+	}
+	if s.freeIndex > s.nelems {
+		v.errorf("span %#x(class %d) has freeIndex(%d) > nelems(%d)", s.startAddr, s.classIndex, s.freeIndex, s.nelems)
+		return
+	}
+	// freeIndex之前的都已分配，之后allocBits为0的是已分配
+	allocated := s.freeIndex
+	for i := s.freeIndex; i < s.nelems; i++ {
+		p, mask := s.allocBits.bitp(i)
+		if atomic.LoadUint32(p)&mask == 0 {
+			allocated++
+		}
+	}
+	if allocated != s.allocCount {
+		v.errorf("span %#x(class %d) has allocCount(%d) but allocBits count %d allocated", s.startAddr, s.classIndex, s.allocCount, allocated)
+	}
+}
+
+// treap 校验空闲页treap，返回所有空闲chunk
+func (v *heapVerifier) treap() []pageRange {
+	h := v.h
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var chunks []pageRange
+	root := h.freeChunks.treap
+	if root != nil && root.parent != nil {
+		v.errorf("treap root %p has parent %p", root, root.parent)
+	}
+	var prev *treapNode
+	var walk func(t *treapNode, depth int)
+	walk = func(t *treapNode, depth int) {
+		if t == nil {
+			return
+		}
+		if depth > 1000 {
+			v.errorf("treap is too deep, maybe has a cycle at node %p", t)
+			return
+		}
+		if err := checkTreapNode(t); err != nil {
+			v.errorf("treap node %p: %s", t, err)
+		}
+		for _, child := range []*treapNode{t.left, t.right} {
+			if child == nil {
+				continue
+			}
+			if child.parent != t {
+				v.errorf("treap node %p has parent %p, want %p", child, child.parent, t)
+			}
+			if child.priority < t.priority {
+				v.errorf("treap node %p priority(%d) < parent %p priority(%d)", child, child.priority, t, t.priority)
+			}
+		}
+		walk(t.left, depth+1)
+		// 中序遍历必须按(npages, base)严格递增
+		if prev != nil && (prev.npagesKey > t.npagesKey || (prev.npagesKey == t.npagesKey && prev.chunk.base() >= t.chunk.base())) {
+			v.errorf("treap is out of order: (%d, %#x) before (%d, %#x)", prev.npagesKey, prev.chunk.base(), t.npagesKey, t.chunk.base())
+		}
+		prev = t
+		chunks = append(chunks, pageRange{start: t.chunk.startAddr, npages: t.chunk.npages})
+		walk(t.right, depth+1)
+	}
+	walk(root, 0)
+	return chunks
+}
+
+// overlap 空闲chunk和span两两不重叠
+func (v *heapVerifier) overlap(ranges []pageRange) {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	for i := 1; i < len(ranges); i++ {
+		if prev, cur := ranges[i-1], ranges[i]; cur.start < prev.end() {
+			v.errorf("%s overlaps %s", prev, cur)
+		}
+	}
+}
+
+// addrMap span的每一页都映射到span本身，空闲页不映射到任何span
+func (v *heapVerifier) addrMap(spans, chunks []pageRange) {
+	h := v.h
+	for _, r := range spans {
+		for p := r.start; p < r.end(); p += _PageSize {
+			span, err := h.spanOf(p)
+			if err != nil {
+				v.errorf("page %#x of %s is not in addrMap: %s", p, r, err)
+				break
+			}
+			if span != r.span {
+				v.errorf("page %#x of %s maps to span %p, want %p", p, r, span, unsafe.Pointer(r.span))
+				break
+			}
+		}
+	}
+	for _, r := range chunks {
+		for p := r.start; p < r.end(); p += _PageSize {
+			span, err := h.spanOf(p)
+			if err != nil {
+				v.errorf("page %#x of %s is not in addrMap: %s", p, r, err)
+				break
+			}
+			if span != nil {
+				v.errorf("page %#x of %s still maps to span %#x(class %d)", p, r, span.startAddr, span.classIndex)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestVerifyRandom(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := m.(*mm).h
+	rnd := rand.New(rand.NewSource(1))
+	var live []uintptr
+	for step := 0; step < 20000; step++ {
+		if len(live) > 0 && rnd.Intn(3) == 0 {
+			i := rnd.Intn(len(live))
+			if err := m.Free(live[i]); err != nil {
+				t.Fatal(err)
+			}
+			live[i] = live[len(live)-1]
+			live = live[:len(live)-1]
+		} else {
+			size := uintptr(rnd.Intn(1024) + 1)
+			if rnd.Intn(100) == 0 {
+				size = uintptr(rnd.Intn(4*_MaxSmallSize) + _MaxSmallSize + 1)
+			}
+			p, err := m.Alloc(size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			live = append(live, uintptr(p))
+		}
+		if step%500 == 0 {
+			// 跳过sweep的节流，强制回收
+			h.sweepLastTime = h.sweepLastTime.Add(-2e9)
+			h.sweep()
+			if err := m.Verify(); err != nil {
+				t.Fatal(step, err)
+			}
+		}
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyCorruption(t *testing.T) {
+	f := &Factory{}
+	m, err := f.CreateMemory(0.75)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := m.Alloc(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	h := m.(*mm).h
+	span, err := h.spanOf(uintptr(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	span.allocCount++
+	h.classSpan[span.classIndex].free.insert(span)
+	// 和span重叠的空闲页
+	chunk := &xChunk{startAddr: span.startAddr, npages: 1}
+	if err := h.freeChunks.insert(chunk); err != nil {
+		t.Fatal(err)
+	}
+	h.freeChunks.treap.priority = ^uint32(0)
+
+	err = m.Verify()
+	var ve *VerifyError
+	if !errors.As(err, &ve) {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"allocCount", "is on both", "overlaps", "still maps to span", "priority"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Error("missing", want, "in", err)
+		}
+	}
+}
+
+func TestVerifyErrorIsAs(t *testing.T) {
+	mlock := &MlockError{Err: errors.New("EPERM")}
+	var err error = &VerifyError{Errs: []error{fmt.Errorf("span: %w", NilError), mlock}}
+	if !errors.Is(err, NilError) || errors.Is(err, InteriorPointerError) {
+		t.Fatal("Is")
+	}
+	var me *MlockError
+	if !errors.As(err, &me) || me != mlock {
+		t.Fatal("As")
+	}
+	var ce *CorruptionError
+	if errors.As(err, &ce) {
+		t.Fatal("As matched a missing type")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// ObjectInfo Walk遍历到的存活对象
+type ObjectInfo struct {
+	Addr      uintptr // 对象地址
+	Size      uintptr // 对象占用的大小：小对象为size class大小，大对象为整个span
+	SizeClass uint8   // 0为大对象(包括RawAlloc)
+	SpanStart uintptr // 所在span的起始地址
+	SpanPages uintptr // 所在span的页数
+	Raw       bool    // RawAlloc分配的
+}
+
+// Walk 按地址顺序遍历所有已分配且没有被Free的对象，fn返回false时停止。
+// 每个span在span锁内取出存活对象后才回调fn，fn中可以Alloc/Free，但并发修改的对象不保证被遍历到。
+func (m *mm) Walk(fn func(obj ObjectInfo) bool) {
+	sp, ok := m.sp.(*xSpanPool)
+	if !ok {
+		return
+	}
+	type walkSpan struct {
+		span *xSpan
+		raw  bool
+	}
+	var spans []walkSpan
+	_ = sp.foreachSpan(func(span *xSpan, kind spanKind) error {
+		spans = append(spans, walkSpan{span: span, raw: kind == spanRaw})
+		return nil
+	})
+	sort.Slice(spans, func(i, j int) bool { return spans[i].span.startAddr < spans[j].span.startAddr })
+	var objs []ObjectInfo
+	for _, s := range spans {
+		objs = s.span.liveObjects(objs[:0], s.raw)
+		for _, obj := range objs {
+			if m.h.debug != nil && m.h.debug.isQuarantined(obj.Addr) {
+				// Poison模式隔离区中的对象已经被Free
+				continue
+			}
+			if !fn(obj) {
+				return
+			}
+		}
+	}
+}
+
+// liveObjects 将span中的存活对象追加到objs
+func (s *xSpan) liveObjects(objs []ObjectInfo, raw bool) []ObjectInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	obj := ObjectInfo{SizeClass: uint8(s.classIndex), SpanStart: s.startAddr, SpanPages: s.npages, Raw: raw}
+	if s.classIndex == 0 {
+		// 大对象，没有初始化bitmap的是RawAlloc分配的span
+		if s.gcmarkBits != nil && s.markBitsForBase().isMarked() {
+			return objs
+		}
+		obj.Addr, obj.Size = s.startAddr, s.npages*_PageSize
+		if s.guarded {
+			obj.Addr, obj.Size = s.guardedAddr(), s.classSize
+		}
+		return append(objs, obj)
+	}
+	obj.Size = s.classSize
+	for i := uintptr(0); i < s.nelems; i++ {
+		if s.isLive(i) {
+			obj.Addr = s.base() + i*s.classSize
+			objs = append(objs, obj)
+		}
+	}
+	return objs
+}
+
+// isLive 第i个slot已分配并且没有等待sweep的释放标记。
+// freeIndex之前的slot都已分配，之后的slot在allocBits中为0的是上次sweep时存活的
+func (s *xSpan) isLive(i uintptr) bool {
+	if i >= s.freeIndex {
+		p, mask := s.allocBits.bitp(i)
+		if atomic.LoadUint32(p)&mask != 0 {
+			return false
+		}
+	}
+	return !s.markBitsForIndex(i).isMarked()
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2022 XMM project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// XMM Project Site: https://github.com/heiyeluren
+// XMM URL: https://github.com/heiyeluren/XMM
+//
+
+package xmm
+
+import (
+	"testing"
+)
+
+func walkAll(m XMemory) map[uintptr]ObjectInfo {
+	objs := make(map[uintptr]ObjectInfo)
+	m.Walk(func(obj ObjectInfo) bool {
+		objs[obj.Addr] = obj
+		return true
+	})
+	return objs
+}
+
+func TestWalk(t *testing.T) {
+	for _, opts := range []Options{{}, {Poison: true, Quarantine: 4}, {GuardPages: true}} {
+		f := &Factory{}
+		m, err := f.CreateMemoryWithOptions(0.75, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if objs := walkAll(m); len(objs) != 0 {
+			t.Fatal(objs)
+		}
+		live := make(map[uintptr]uintptr)
+		var freed []uintptr
+		for i := 0; i < 3000; i++ {
+			size := uintptr(i%200 + 1)
+			p, err := m.Alloc(size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%3 == 0 {
+				freed = append(freed, uintptr(p))
+			} else {
+				live[uintptr(p)] = size
+			}
+		}
+		big, err := m.Alloc(_MaxSmallSize * 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live[uintptr(big)] = _MaxSmallSize * 2
+		chunk, err := m.RawAlloc(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live[chunk.StartAddr] = 3 * _PageSize
+		for _, addr := range freed {
+			if err := m.Free(addr); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		objs := walkAll(m)
+		if len(objs) != len(live) {
+			t.Fatal(opts, len(objs), len(live))
+		}
+		for addr, size := range live {
+			obj, ok := objs[addr]
+			if !ok || obj.Size < size || addr < obj.SpanStart || addr+size > obj.SpanStart+obj.SpanPages*_PageSize {
+				t.Fatal(opts, addr, size, obj)
+			}
+			if !obj.Raw && (obj.SizeClass == 0) != (size > _MaxSmallSize) {
+				t.Fatal(opts, addr, size, obj)
+			}
+		}
+		if obj := objs[chunk.StartAddr]; !obj.Raw {
+			t.Fatal(obj)
+		}
+
+		var n int
+		m.Walk(func(obj ObjectInfo) bool {
+			n++
+			return n < 10
+		})
+		if n != 10 {
+			t.Fatal(n)
+		}
+	}
+}
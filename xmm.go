@@ -21,11 +21,19 @@ package xmm
 import (
 	"errors"
 	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sync"
 	"unsafe"
 )
 
 var NilError = errors.New("params is illegal")
 
+var InteriorPointerError = errors.New("addr is not the start of an allocation, use FreeGroup")
+
+var DuplicateFreeError = errors.New("addr is freed more than once in a batch")
+
 type spanPool interface {
 	// Alloc 分配一般对象
 	Alloc(byteSize uintptr) (p unsafe.Pointer, err error)
@@ -38,6 +46,18 @@ type spanPool interface {
 
 	// Copy2 byte内存拷贝(拷贝两个) item1-> newItem1   item2-> newItem2
 	Copy2(item1 []byte, item2 []byte) (newItem1 []byte, newItem2 []byte, err error)
+
+	// AllocBatch 批量分配n(不超过len(out))个size大小的对象到out中，返回分配的个数
+	AllocBatch(size uintptr, n int, out []unsafe.Pointer) (int, error)
+
+	// FreeBatch 批量释放，地址重复或不是对象起始地址时返回错误，整批都不释放
+	FreeBatch(addrs []uintptr) error
+
+	// CopyN byte内存拷贝(拷贝多个)，一次分配，返回的数组共用一块内存
+	CopyN(items ...[]byte) ([][]byte, error)
+
+	// FreeGroup 释放Copy2/CopyN/From2/FromN的共用内存，addr可以是其中任一元素的地址
+	FreeGroup(addr uintptr) error
 }
 
 type stringAllocator interface {
@@ -47,10 +67,18 @@ type stringAllocator interface {
 	// From2 分配2个string xmm内存，并拷贝到xmm内存中
 	From2(item1 string, item2 string) (newItem1 string, newItem2 string, err error)
 
-	// FromInAddr 将contents拷贝到addr内存地址中
+	// FromInAddr 将contents拷贝到addr内存地址中，每个StringHeader后紧跟其内容，addr处需要至少StringArenaSize(contents...)字节
+	//
+	// Deprecated: 使用StringArena/PackStrings，由其计算大小并负责分配和释放
 	FromInAddr(addr uintptr, contents ...string) (p []*string, err error)
 
-	// FreeString 释放字符串
+	// FromN 分配多个string xmm内存，一次分配，返回的string共用一块内存
+	FromN(items ...string) ([]string, error)
+
+	// FreeStringGroup 释放From2/FromN的共用内存，content可以是其中任一string
+	FreeStringGroup(content string) error
+
+	// FreeString 释放字符串，From2/FromN返回的string使用FreeStringGroup
 	FreeString(content string) error
 }
 
@@ -68,41 +96,175 @@ type XMemory interface {
 
 	// GetPageSize 得到页大小
 	GetPageSize() uintptr
+
+	// Snapshot 将堆序列化到w(调用期间需要暂停分配和释放)，通过Factory.Restore恢复
+	Snapshot(w io.Writer) error
+
+	// LeakReport 按分配调用栈汇总尚未释放的对象，需要开启Options.TrackLeaks，否则返回nil
+	LeakReport() Leaks
+
+	// WriteHeapProfile 写出pprof格式(gzip压缩的profile.proto)的采样分配profile，需要设置Options.ProfileRate
+	WriteHeapProfile(w io.Writer) error
+
+	// Walk 遍历所有存活对象，fn返回false时停止
+	Walk(fn func(obj ObjectInfo) bool)
+
+	// Verify 校验整个堆的一致性，发现问题时返回*VerifyError
+	Verify() error
+
+	// FragmentationReport 统计每个size class的内部/外部碎片、空闲页直方图和arena占用
+	FragmentationReport() *FragmentationReport
+
+	// SizeProfile warm-up期间采样的请求大小分布，需要设置Options.SizeSamples，否则返回nil。
+	// 通过TuneSizeClasses生成新的size class表
+	SizeProfile() *SizeProfile
+
+	// AllocHandle 分配可以被Compact移动的对象，通过Pin/Unpin访问，FreeHandle释放
+	AllocHandle(size uintptr) (Handle, error)
+
+	// Pin 返回句柄对象的当前地址，Unpin之前不会被移动
+	Pin(h Handle) (unsafe.Pointer, error)
+
+	// Unpin 和Pin成对调用
+	Unpin(h Handle) error
+
+	// FreeHandle 释放句柄对象
+	FreeHandle(h Handle) error
+
+	// Compact 把稀疏span中没有被Pin的句柄对象搬走，并把清空的span还给页堆
+	Compact() (*CompactStats, error)
 }
 
 type mm struct {
-	sp spanPool
-	sa stringAllocator
-	h  *xHeap
+	sp    spanPool
+	sa    stringAllocator
+	h     *xHeap
+	leaks *leakTracker   // Options.TrackLeaks
+	prof  *allocProfiler // Options.ProfileRate
+	sizes *sizeHistogram // Options.SizeSamples
+
+	handles     handleTable // 见handle.go
+	compactLock sync.Mutex
 }
 
 func (m *mm) Copy2(item1 []byte, item2 []byte) (newItem1 []byte, newItem2 []byte, err error) {
-	return m.sp.Copy2(item1, item2)
+	newItem1, newItem2, err = m.sp.Copy2(item1, item2)
+	if err == nil && len(item1)+len(item2) > 0 {
+		m.onAlloc((*reflect.SliceHeader)(unsafe.Pointer(&newItem1)).Data, uintptr(len(item1)+len(item2)))
+	}
+	return newItem1, newItem2, err
+}
+
+func (m *mm) CopyN(items ...[]byte) ([][]byte, error) {
+	out, err := m.sp.CopyN(items...)
+	if err == nil {
+		// 第一个非空元素就是分配的起始地址
+		var base, size uintptr
+		for _, item := range out {
+			if len(item) > 0 && base == 0 {
+				base = (*reflect.SliceHeader)(unsafe.Pointer(&item)).Data
+			}
+			size += uintptr(len(item))
+		}
+		if size > 0 {
+			m.onAlloc(base, size)
+		}
+	}
+	return out, err
+}
+
+func (m *mm) FreeGroup(addr uintptr) error {
+	if addr < 1 {
+		return NilError
+	}
+	base, err := m.h.objectBase(addr)
+	if err != nil {
+		return err
+	}
+	return m.Free(base)
 }
 
 func (m *mm) Alloc(byteSize uintptr) (p unsafe.Pointer, err error) {
 	if byteSize < 1 {
 		return nil, NilError
 	}
-	return m.sp.Alloc(byteSize)
+	p, err = m.sp.Alloc(byteSize)
+	if err == nil {
+		m.onAlloc(uintptr(p), byteSize)
+	}
+	return p, err
 }
 
 func (m *mm) AllocSlice(eleSize uintptr, cap, len uintptr) (p unsafe.Pointer, err error) {
 	if eleSize < 1 || cap < 1 {
 		return nil, NilError
 	}
-	return m.sp.AllocSlice(eleSize, cap, len)
+	p, err = m.sp.AllocSlice(eleSize, cap, len)
+	if err == nil {
+		m.onAlloc(uintptr(p), eleSize*cap+unsafe.Sizeof(reflect.SliceHeader{}))
+	}
+	return p, err
+}
+
+func (m *mm) AllocBatch(size uintptr, n int, out []unsafe.Pointer) (int, error) {
+	if size < 1 || n < 0 {
+		return 0, NilError
+	}
+	got, err := m.sp.AllocBatch(size, n, out)
+	for _, p := range out[:got] {
+		m.onAlloc(uintptr(p), size)
+	}
+	return got, err
+}
+
+func (m *mm) FreeBatch(addrs []uintptr) error {
+	if err := m.sp.FreeBatch(addrs); err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		m.onFree(addr)
+	}
+	return nil
 }
 
 func (m *mm) From(content string) (p string, err error) {
 	if len(content) < 1 {
 		return "", NilError
 	}
-	return m.sa.From(content)
+	p, err = m.sa.From(content)
+	if err == nil {
+		m.onAlloc((*reflect.StringHeader)(unsafe.Pointer(&p)).Data, uintptr(len(content)))
+	}
+	return p, err
 }
 
 func (m *mm) From2(item1 string, item2 string) (newItem1 string, newItem2 string, err error) {
-	return m.sa.From2(item1, item2)
+	newItem1, newItem2, err = m.sa.From2(item1, item2)
+	if err == nil && len(item1)+len(item2) > 0 {
+		m.onAlloc((*reflect.StringHeader)(unsafe.Pointer(&newItem1)).Data, uintptr(len(item1)+len(item2)))
+	}
+	return newItem1, newItem2, err
+}
+
+func (m *mm) FromN(items ...string) ([]string, error) {
+	out, err := m.sa.FromN(items...)
+	if err == nil {
+		var base, size uintptr
+		for _, item := range out {
+			if len(item) > 0 && base == 0 {
+				base = (*reflect.StringHeader)(unsafe.Pointer(&item)).Data
+			}
+			size += uintptr(len(item))
+		}
+		if size > 0 {
+			m.onAlloc(base, size)
+		}
+	}
+	return out, err
+}
+
+func (m *mm) FreeStringGroup(content string) error {
+	return m.FreeGroup((*reflect.StringHeader)(unsafe.Pointer(&content)).Data)
 }
 
 func (m *mm) FromInAddr(addr uintptr, contents ...string) (p []*string, err error) {
@@ -116,9 +278,20 @@ func (m *mm) RawAlloc(pageNum uintptr) (p *Chunk, err error) {
 	if pageNum < 1 {
 		return p, NilError
 	}
+	if m.h.opts.GuardPages {
+		c, err := m.h.allocGuardedSpan(pageNum, pageNum*_PageSize)
+		if err != nil {
+			return nil, err
+		}
+		m.h.rawSpans.insert(c)
+		m.onAlloc(c.startAddr, pageNum*_PageSize)
+		return &Chunk{StartAddr: c.startAddr, Npages: pageNum}, nil
+	}
 	if c, err := m.h.allocRawSpan(pageNum); err != nil {
 		return nil, err
 	} else {
+		m.h.rawSpans.insert(c)
+		m.onAlloc(c.startAddr, c.npages*_PageSize)
 		return &Chunk{StartAddr: c.startAddr, Npages: c.npages}, nil
 	}
 }
@@ -127,11 +300,58 @@ func (m *mm) Free(addr uintptr) error {
 	if addr < 1 {
 		return NilError
 	}
-	return m.sp.Free(addr)
+	if err := m.sp.Free(addr); err != nil {
+		return err
+	}
+	m.onFree(addr)
+	return nil
 }
 
 func (m *mm) FreeString(content string) error {
-	return m.sa.FreeString(content)
+	if err := m.sa.FreeString(content); err != nil {
+		return err
+	}
+	m.onFree((*reflect.StringHeader)(unsafe.Pointer(&content)).Data)
+	return nil
+}
+
+// onAlloc 分配跟踪(TrackLeaks、ProfileRate)，只能被mm的分配方法直接调用
+func (m *mm) onAlloc(addr, size uintptr) {
+	if m.sizes != nil {
+		m.sizes.add(size)
+	}
+	if m.leaks == nil && m.prof == nil {
+		return
+	}
+	sampled := m.prof != nil && m.prof.sample(size)
+	if m.leaks == nil && !sampled {
+		return
+	}
+	// 跳过runtime.Callers、onAlloc和mm的分配方法
+	var stack callStack
+	runtime.Callers(3, stack[:])
+	if m.leaks != nil {
+		m.leaks.add(addr, size, &stack)
+	}
+	if sampled {
+		m.prof.add(addr, size, &stack)
+	}
+}
+
+func (m *mm) onFree(addr uintptr) {
+	if m.leaks != nil {
+		m.leaks.remove(addr)
+	}
+	if m.prof != nil {
+		m.prof.remove(addr)
+	}
+}
+
+func (m *mm) LeakReport() Leaks {
+	if m.leaks == nil {
+		return nil
+	}
+	return m.leaks.report()
 }
 
 func (m *mm) GetPageSize() uintptr {
@@ -144,10 +364,15 @@ type Factory struct {
 
 // CreateMemory spanFact为负载因子，当span内存超过这个百分比阈值，就会扩容
 func (s *Factory) CreateMemory(spanFact float32) (XMemory, error) {
+	return s.CreateMemoryWithOptions(spanFact, Options{})
+}
+
+// CreateMemoryWithOptions 同CreateMemory，opts为可选配置(见Options)
+func (s *Factory) CreateMemoryWithOptions(spanFact float32, opts Options) (XMemory, error) {
 	if spanFact <= 0 {
 		return nil, NilError
 	}
-	h, err := newXHeap()
+	h, err := newXHeapWithOptions(opts)
 	if err != nil {
 		return nil, err
 	}
@@ -156,8 +381,22 @@ func (s *Factory) CreateMemory(spanFact float32) (XMemory, error) {
 		return nil, err
 	}
 	s.sp = sp
-	sa := newXStringAllocator(sp)
-	return &mm{sp: sp, sa: sa, h: h}, nil
+	return newMM(sp, h, opts), nil
+}
+
+// newMM 按opts创建XMemory的调试/统计组件
+func newMM(sp *xSpanPool, h *xHeap, opts Options) *mm {
+	m := &mm{sp: sp, sa: newXStringAllocator(sp), h: h}
+	if opts.TrackLeaks {
+		m.leaks = newLeakTracker()
+	}
+	if opts.ProfileRate > 0 {
+		m.prof = newAllocProfiler(opts.ProfileRate)
+	}
+	if opts.SizeSamples > 0 {
+		m.sizes = newSizeHistogram(opts.SizeSamples)
+	}
+	return m
 }
 
 func (s *Factory) PrintStatus() {
@@ -165,9 +404,8 @@ func (s *Factory) PrintStatus() {
 		if u < 100 {
 			continue
 		}
-		pageNum := class_to_allocnpages[index]
-		size := class_to_size[index]
-		pageNum = uint8(Align(Align(uintptr(size), _PageSize)/uintptr(_PageSize), uintptr(pageNum)))
-		fmt.Println(index, u, uintptr(pageNum)*_PageSize/uintptr(size))
+		pageNum := s.sp.heap.classes.spanPages(index)
+		size := s.sp.heap.classes.size[index]
+		fmt.Println(index, u, pageNum*_PageSize/uintptr(size))
 	}
 }